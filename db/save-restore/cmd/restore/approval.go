@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// restorePlan is what --approval-command receives as JSON on stdin: what is
+// about to be restored where, and what will be destroyed by it.
+type restorePlan struct {
+	Host           string     `json:"host"`
+	Backup         string     `json:"backup"`
+	BackupDir      string     `json:"backup_dir"`
+	Format         string     `json:"format"`
+	Files          []string   `json:"files,omitempty"`
+	BackupSize     int64      `json:"backup_size"`
+	BackupCreated  *time.Time `json:"backup_created,omitempty"`
+	PGVersion      string     `json:"pg_version,omitempty"`
+	StartLSN       string     `json:"start_lsn,omitempty"`
+	DataDir        string     `json:"data_dir"`
+	DataDirSize    int64      `json:"data_dir_size"`
+	DataDirFiles   int        `json:"data_dir_files"`
+	RecoveryTarget string     `json:"recovery_target,omitempty"`
+	CopyMethod     string     `json:"copy_method"`
+
+	// Tablespaces maps the OID of each tablespace archive to where it is
+	// restored.
+	Tablespaces map[string]string `json:"tablespaces,omitempty"`
+}
+
+// buildPlan describes the restore about to happen. source is the backup as
+// given on the command line, before an archive was unpacked.
+func buildPlan(config *Config, source string, backupInfo *BackupInfo) *restorePlan {
+	plan := &restorePlan{
+		Backup:     source,
+		BackupDir:  config.BackupPath,
+		Format:     backupInfo.Format,
+		DataDir:    config.DataDir,
+		CopyMethod: config.CopyMethod,
+	}
+	plan.Host, _ = os.Hostname()
+	for _, file := range backupInfo.Files {
+		plan.Files = append(plan.Files, filepath.Base(file))
+	}
+	plan.RecoveryTarget, _ = recoveryTarget(config)
+	for _, t := range backupInfo.Tablespaces {
+		if plan.Tablespaces == nil {
+			plan.Tablespaces = map[string]string{}
+		}
+		plan.Tablespaces[t.OID] = t.Location
+	}
+
+	if m, err := manifest.Read(config.BackupPath); err == nil {
+		plan.BackupSize = m.Size
+		if !m.CreatedAt.IsZero() {
+			plan.BackupCreated = &m.CreatedAt
+		}
+		plan.PGVersion = m.PGVersion
+		plan.StartLSN = m.StartLSN
+	} else {
+		plan.BackupSize, _ = treeSize(config.BackupPath)
+	}
+	plan.DataDirSize, plan.DataDirFiles = treeSize(config.DataDir)
+	return plan
+}
+
+// treeSize returns the total size and number of files under dir, ignoring
+// anything that cannot be read.
+func treeSize(dir string) (int64, int) {
+	var size int64
+	var files int
+	filepath.Walk(dir, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files
+}
+
+// requestApproval runs --approval-command through the shell with the plan as
+// JSON on stdin. Anything but a zero exit status means the restore is not
+// approved. The command's output is shown to the operator.
+func requestApproval(config *Config, plan *restorePlan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would ask for approval with: "+config.ApprovalCommand)
+		fmt.Println(string(data))
+		return nil
+	}
+
+	printMsg(colorBlue, "\nRequesting approval: "+config.ApprovalCommand)
+	cmd := exec.Command("sh", "-c", config.ApprovalCommand)
+	cmd.Stdin = bytes.NewReader(append(data, '\n'))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("restore not approved by --approval-command: %w", err)
+	}
+
+	printMsg(colorGreen, "✓ Restore approved")
+	return nil
+}
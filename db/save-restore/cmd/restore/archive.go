@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+)
+
+// unpackArchive detects a single-file backup archive given as --backup,
+// unpacks it into a staging directory and points config.BackupPath at the
+// backup directory inside it. The returned function removes the staging
+// directory again.
+func unpackArchive(config *Config) (func(), error) {
+	noop := func() {}
+
+	info, err := os.Stat(config.BackupPath)
+	if err != nil || info.IsDir() || !strings.HasSuffix(config.BackupPath, backupfs.ArchiveSuffix) {
+		return noop, nil
+	}
+
+	staging, err := os.MkdirTemp(config.StagingDir, "restore-staging-")
+	if err != nil {
+		return noop, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	cleanup := func() {
+		os.RemoveAll(staging)
+	}
+
+	printMsg(colorBlue, fmt.Sprintf("Unpacking archive %s into %s...", filepath.Base(config.BackupPath), staging))
+
+	dir, err := backupfs.UnpackArchive(config.BackupPath, staging)
+	if err != nil {
+		cleanup()
+		return noop, err
+	}
+
+	config.BackupPath = dir
+	printMsg(colorGreen, "✓ Archive unpacked")
+
+	return cleanup, nil
+}
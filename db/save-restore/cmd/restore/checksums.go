@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// readControlData runs pg_controldata on the data directory and returns its
+// "key: value" lines.
+func readControlData(dataDir string) (map[string]string, error) {
+	out, err := exec.Command("pg_controldata", "-D", dataDir).Output()
+	if err != nil {
+		return nil, fmt.Errorf("pg_controldata failed: %w", err)
+	}
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if ok {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values, scanner.Err()
+}
+
+// checkDataChecksums compares the restored cluster's data checksum setting,
+// as recorded in pg_control, with the one the save tool recorded from the
+// source cluster, and warns when they differ.
+func checkDataChecksums(config *Config) {
+	if config.DryRun {
+		return
+	}
+
+	m, err := manifest.Read(config.BackupPath)
+	if err != nil || m.DataChecksums == "" {
+		return
+	}
+
+	control, err := readControlData(config.DataDir)
+	if err != nil {
+		warn("Could not check data checksums: " + err.Error())
+		return
+	}
+
+	version, ok := control["Data page checksum version"]
+	if !ok {
+		warn("pg_controldata did not report a data page checksum version")
+		return
+	}
+	restored := "on"
+	if version == "0" {
+		restored = "off"
+	}
+
+	if restored != m.DataChecksums {
+		warn(fmt.Sprintf("Source cluster had data_checksums = %s but the restored cluster has them %s",
+			m.DataChecksums, restored))
+		return
+	}
+	printMsg(colorGreen, fmt.Sprintf("✓ Data checksums %s, matching the source cluster", restored))
+}
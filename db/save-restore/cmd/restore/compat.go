@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// versionPattern matches the version strings the compatibility checks take,
+// such as "16", "9.6" or "2.14.2".
+var versionPattern = regexp.MustCompile(`^\d+(\.\d+)*$`)
+
+// version is a dotted version number.
+type version []int
+
+func parseVersion(s string) (version, error) {
+	if !versionPattern.MatchString(s) {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	var v version
+	for _, part := range strings.Split(s, ".") {
+		n, _ := strconv.Atoi(part)
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// compare returns -1, 0 or 1 as v is older than, equal to or newer than o.
+// Missing parts count as 0, so "2.14" equals "2.14.0".
+func (v version) compare(o version) int {
+	for i := 0; i < len(v) || i < len(o); i++ {
+		a, b := 0, 0
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(o) {
+			b = o[i]
+		}
+		if a != b {
+			if a < b {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func (v version) major() int { return v[0] }
+
+// timescaleRule is one entry of the TimescaleDB compatibility rules. The first
+// rule that applies to a backup and target version decides.
+type timescaleRule struct {
+	applies func(backup, target version) bool
+	abort   bool
+	message string
+}
+
+// timescaleRules encodes what has to be remembered about moving a physical
+// TimescaleDB backup to another extension version. The catalog in the
+// backup is at the backup's version, so the target has to load that version
+// or update from it.
+var timescaleRules = []timescaleRule{
+	{
+		applies: func(b, t version) bool { return t.major() < b.major() },
+		abort:   true,
+		message: "downgrading TimescaleDB across major versions is not supported and corrupts the catalog",
+	},
+	{
+		applies: func(b, t version) bool { return t.compare(b) < 0 },
+		abort:   true,
+		message: "the target's TimescaleDB is older than the backup's; downgrades are not supported, use a target with the backup's version",
+	},
+	{
+		applies: func(b, t version) bool { return t.major() > b.major() },
+		abort:   true,
+		message: "upgrading across TimescaleDB major versions has to be done in a cluster running the old version; restore into a target with the backup's version and upgrade there",
+	},
+	{
+		applies: func(b, t version) bool { return t.compare(b) > 0 },
+		message: "the target's TimescaleDB is newer; it must still ship the backup's timescaledb-<version>.so, and ALTER EXTENSION timescaledb UPDATE has to be run in each database after the restore",
+	},
+}
+
+// checkCompatibility checks the PostgreSQL major version, the WAL directory
+// layout and the TimescaleDB version of the backup against the target. A
+// different PostgreSQL major version always aborts the restore. TimescaleDB
+// combinations that cannot work abort it unless
+// --allow-timescale-version-mismatch is given, others only warn. Versions
+// that cannot be determined are skipped.
+func checkCompatibility(config *Config, backupInfo *BackupInfo) error {
+	m, err := manifest.Read(config.BackupPath)
+	if err != nil {
+		m = &manifest.Manifest{}
+	}
+
+	var problems []string
+	report := func(abort bool, msg string) {
+		if abort {
+			problems = append(problems, msg)
+		} else {
+			warn(msg)
+		}
+	}
+
+	backupPG := backupPGVersion(config, backupInfo, m.PGVersion)
+	targetPG := config.TargetPGVersion
+	if targetPG == "" {
+		targetPG = installedPGVersion()
+	}
+	if err := checkWALLayout(config, backupInfo, backupPG, targetPG); err != nil {
+		return err
+	}
+	if backupPG != "" && targetPG != "" {
+		if backupPG != targetPG {
+			return fmt.Errorf("backup is from PostgreSQL %s but the target runs PostgreSQL %s; physical backups only restore into the same major version",
+				backupPG, targetPG)
+		}
+		printMsg(colorGreen, fmt.Sprintf("✓ PostgreSQL %s matches the target", targetPG))
+	}
+
+	targetTS := config.TargetTimescaleVersion
+	if targetTS == "" {
+		targetTS = installedTimescaleVersion(config)
+	}
+	for _, ext := range groupExtensions(m.Extensions) {
+		if ext.Name != "timescaledb" {
+			continue
+		}
+		if targetTS == "" {
+			warn("Could not determine the target's TimescaleDB version (set --target-timescale-version), skipping the compatibility check")
+			break
+		}
+		backup, err := parseVersion(ext.Version)
+		if err != nil {
+			warn(fmt.Sprintf("Cannot compare TimescaleDB version %q of the backup", ext.Version))
+			continue
+		}
+		target, err := parseVersion(targetTS)
+		if err != nil {
+			warn(fmt.Sprintf("Cannot compare TimescaleDB version %q of the target", targetTS))
+			break
+		}
+
+		matched := false
+		for _, rule := range timescaleRules {
+			if rule.applies(backup, target) {
+				report(rule.abort, fmt.Sprintf("TimescaleDB %s (used in %s) to %s: %s",
+					ext.Version, strings.Join(ext.Databases, ", "), targetTS, rule.message))
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			printMsg(colorGreen, fmt.Sprintf("✓ TimescaleDB %s matches the target", ext.Version))
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	if config.AllowTimescaleMismatch {
+		for _, problem := range problems {
+			warn(problem + " (allowed by --allow-timescale-version-mismatch)")
+		}
+		return nil
+	}
+	for _, problem := range problems {
+		printMsg(colorRed, "✗ "+problem)
+	}
+	return fmt.Errorf("backup is not compatible with the target (use --allow-timescale-version-mismatch to restore anyway)")
+}
+
+// installedPGVersion returns the major version of the target installation
+// from pg_config, in the form PG_VERSION uses.
+func installedPGVersion() string {
+	output, err := exec.Command("pg_config", "--version").Output()
+	if err != nil {
+		return ""
+	}
+
+	// "PostgreSQL 16.4 (Debian 16.4-1.pgdg120+1)"
+	fields := strings.Fields(string(output))
+	if len(fields) < 2 {
+		return ""
+	}
+	v, err := parseVersion(strings.TrimRightFunc(fields[1], func(r rune) bool { return r < '0' || r > '9' }))
+	if err != nil {
+		return ""
+	}
+	if v.major() < 10 && len(v) > 1 {
+		return fmt.Sprintf("%d.%d", v[0], v[1])
+	}
+	return strconv.Itoa(v.major())
+}
+
+// installedTimescaleVersion returns the default version of the target's
+// timescaledb extension.
+func installedTimescaleVersion(config *Config) string {
+	dir := config.ExtensionDir
+	if dir == "" {
+		dir = findExtensionDir()
+	}
+	if dir == "" {
+		return ""
+	}
+
+	control := filepath.Join(dir, "timescaledb.control")
+	if _, err := os.Stat(control); err != nil {
+		return ""
+	}
+	if v := defaultVersion(control); v != "unknown" {
+		return v
+	}
+	return ""
+}
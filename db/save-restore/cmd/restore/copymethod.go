@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// Ways of putting a plain backup's files into the data directory.
+const (
+	copyMethodCopy     = "copy"
+	copyMethodReflink  = "reflink"
+	copyMethodHardlink = "hardlink"
+)
+
+// checkCopyMethod warns about the --copy-method and --verify-after-write
+// choices that do not work as asked for the backup's format, while --strict
+// can still stop the restore before the data directory is cleared.
+func checkCopyMethod(config *Config, backupInfo *BackupInfo) {
+	switch {
+	case backupInfo.Format == "tar" && config.CopyMethod != copyMethodCopy:
+		warn("--copy-method only applies to plain backups, extracting tar files")
+	case backupInfo.Format == "plain" && config.CopyMethod == copyMethodHardlink:
+		warn("Hard-linked files are shared with the backup, which changes as soon as the restored cluster writes to them")
+	}
+	if backupInfo.Format == "plain" && config.VerifyAfterWrite {
+		warn("--verify-after-write only applies to tar backups, copying without reading back")
+	}
+}
+
+// linkPlainBackup restores a plain backup with reflinks or hard links
+// instead of copying the data, falling back to a regular copy for the rest
+// of the files as soon as the filesystem refuses one. Directories are
+// created with the data directory mode, symlinks are recreated.
+func linkPlainBackup(config *Config) error {
+	method := config.CopyMethod
+	printMsg(colorYellow, fmt.Sprintf("\nRestoring plain backup files (%s)...", method))
+
+	counts := map[string]int{}
+	err := filepath.Walk(config.BackupPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(config.BackupPath, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		// The save tool's metadata files are not part of the data directory
+		if slices.Contains(manifest.MetadataFiles, rel) {
+			return nil
+		}
+		target := filepath.Join(config.DataDir, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, config.DataDirMode)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !info.Mode().IsRegular():
+			return nil
+		}
+
+		if method != copyMethodCopy {
+			err := placeFile(method, path, target, info)
+			if err == nil {
+				counts[method]++
+				return nil
+			}
+			warn(fmt.Sprintf("Cannot %s %s (%v), copying the remaining files", method, rel, err))
+			method = copyMethodCopy
+		}
+		if err := copyFile(path, target, info); err != nil {
+			return fmt.Errorf("failed to copy %s: %w", rel, err)
+		}
+		counts[copyMethodCopy]++
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore backup: %w", err)
+	}
+
+	if err := os.Chmod(config.DataDir, config.DataDirMode); err != nil {
+		return fmt.Errorf("failed to set directory permissions: %w", err)
+	}
+
+	switch {
+	case counts[copyMethodCopy] == 0:
+		printMsg(colorGreen, fmt.Sprintf("✓ Plain backup restored with %s (%d files)", config.CopyMethod, counts[config.CopyMethod]))
+	case counts[config.CopyMethod] == 0:
+		printMsg(colorGreen, fmt.Sprintf("✓ Plain backup restored with copy (%d files), %s is not supported here", counts[copyMethodCopy], config.CopyMethod))
+	default:
+		printMsg(colorGreen, fmt.Sprintf("✓ Plain backup restored: %d files with %s, %d copied",
+			counts[config.CopyMethod], config.CopyMethod, counts[copyMethodCopy]))
+	}
+	return nil
+}
+
+// placeFile puts src at dst with the given method.
+func placeFile(method, src, dst string, info os.FileInfo) error {
+	if method == copyMethodHardlink {
+		return os.Link(src, dst)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if err := reflink(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// copyFile copies src to dst, keeping the mode and modification time.
+func copyFile(src, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
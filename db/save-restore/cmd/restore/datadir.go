@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+)
+
+// protectedDirs are system directories that are never a data directory;
+// clearing one would wreck the host or container.
+var protectedDirs = map[string]bool{
+	"/": true, "/bin": true, "/boot": true, "/dev": true, "/etc": true,
+	"/home": true, "/lib": true, "/lib64": true, "/opt": true, "/proc": true,
+	"/root": true, "/run": true, "/sbin": true, "/srv": true, "/sys": true,
+	"/tmp": true, "/usr": true, "/var": true, "/var/lib": true,
+}
+
+// resolveDataDir replaces config.DataDir with its absolute, symlink-free
+// path. Container setups often make the data directory a symlink to the
+// actual storage; removing its contents, walking it for chown and locking it
+// all have to act on the real directory, not on the link. A data directory
+// that does not exist yet is resolved through its nearest existing parent.
+// Dangling links and system directories are refused.
+func resolveDataDir(config *Config) error {
+	given := config.DataDir
+	abs, err := filepath.Abs(given)
+	if err != nil {
+		return fmt.Errorf("failed to resolve data directory %s: %w", given, err)
+	}
+
+	if info, err := os.Lstat(abs); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		if _, err := os.Stat(abs); err != nil {
+			target, _ := os.Readlink(abs)
+			return fmt.Errorf("data directory %s is a symlink to %s, which cannot be used: %w", given, target, err)
+		}
+	}
+
+	resolved, err := backupfs.Resolve(abs)
+	if err != nil {
+		return fmt.Errorf("failed to resolve data directory %s: %w", given, err)
+	}
+
+	if protectedDirs[resolved] {
+		return fmt.Errorf("refusing to use %s as the data directory (resolved from %s)", resolved, given)
+	}
+	if resolved != filepath.Clean(given) {
+		printMsg(colorBlue, fmt.Sprintf("Data directory %s resolves to %s", given, resolved))
+	}
+	config.DataDir = resolved
+	return nil
+}
+
+// checkBackupOutsideDataDir refuses a backup stored inside the data
+// directory, which clearing the data directory would delete, and a data
+// directory inside the backup, which restoring would copy into itself.
+func checkBackupOutsideDataDir(config *Config) error {
+	backup, err := backupfs.Resolve(config.BackupPath)
+	if err != nil {
+		return nil
+	}
+	if backupfs.Within(config.DataDir, backup) {
+		return fmt.Errorf("backup %s is inside the data directory %s, which restoring would clear", config.BackupPath, config.DataDir)
+	}
+	if backupfs.Within(backup, config.DataDir) {
+		return fmt.Errorf("data directory %s is inside the backup %s", config.DataDir, config.BackupPath)
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fadvDontNeed is POSIX_FADV_DONTNEED.
+const fadvDontNeed = 4
+
+// evictFile drops the cached pages of f, which must have been synced, so
+// that it is read back from the disk rather than from memory.
+func evictFile(f *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// checkExtensions compares the extensions recorded in the backup's manifest
+// with the extension files of the target PostgreSQL installation and warns
+// about any that are missing or only available in a different version. A
+// cluster whose catalogs reference an extension the binaries lack fails to
+// start or to load its data.
+func checkExtensions(config *Config) {
+	m, err := manifest.Read(config.BackupPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warn("Could not read manifest, skipping extension check: " + err.Error())
+		}
+		return
+	}
+	if len(m.Extensions) == 0 {
+		return
+	}
+
+	required := groupExtensions(m.Extensions)
+
+	dir := config.ExtensionDir
+	if dir == "" {
+		dir = findExtensionDir()
+	}
+	if dir == "" {
+		warn("Could not locate the target's extension directory (set --extension-dir), make sure it provides:")
+		for _, ext := range required {
+			printMsg(colorYellow, fmt.Sprintf("  %s %s (%s)", ext.Name, ext.Version, strings.Join(ext.Databases, ", ")))
+		}
+		return
+	}
+
+	problems := 0
+	for _, ext := range required {
+		control := filepath.Join(dir, ext.Name+".control")
+		if _, err := os.Stat(control); err != nil {
+			warn(fmt.Sprintf("Extension %s %s (used in %s) is not installed in the target",
+				ext.Name, ext.Version, strings.Join(ext.Databases, ", ")))
+			problems++
+			continue
+		}
+
+		if !providesVersion(dir, ext.Name, ext.Version) {
+			warn(fmt.Sprintf("Extension %s %s (used in %s) does not match the target, which provides version %s",
+				ext.Name, ext.Version, strings.Join(ext.Databases, ", "), defaultVersion(control)))
+			problems++
+		}
+	}
+
+	if problems == 0 {
+		printMsg(colorGreen, fmt.Sprintf("✓ All %d extensions in the backup are available in the target", len(required)))
+	}
+}
+
+// providesVersion reports whether dir has an install script
+// <name>--<version>.sql or an upgrade script <name>--<old>--<version>.sql,
+// either of which means the target knows that version. PostgreSQL does not
+// allow "--" in extension names or versions, so the fields split cleanly.
+func providesVersion(dir, name, version string) bool {
+	scripts, _ := filepath.Glob(filepath.Join(dir, name+"--*.sql"))
+	for _, script := range scripts {
+		fields := strings.Split(strings.TrimSuffix(filepath.Base(script), ".sql"), "--")
+		if fields[0] != name || len(fields) > 3 {
+			continue
+		}
+		if fields[len(fields)-1] == version {
+			return true
+		}
+	}
+	return false
+}
+
+// requiredExtension is an extension version and the databases using it.
+type requiredExtension struct {
+	Name      string
+	Version   string
+	Databases []string
+}
+
+func groupExtensions(extensions []manifest.Extension) []*requiredExtension {
+	byKey := map[string]*requiredExtension{}
+	var result []*requiredExtension
+	for _, ext := range extensions {
+		key := ext.Name + " " + ext.Version
+		req, ok := byKey[key]
+		if !ok {
+			req = &requiredExtension{Name: ext.Name, Version: ext.Version}
+			byKey[key] = req
+			result = append(result, req)
+		}
+		req.Databases = append(req.Databases, ext.Database)
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// findExtensionDir asks pg_config for the installation's share directory.
+func findExtensionDir() string {
+	output, err := exec.Command("pg_config", "--sharedir").Output()
+	if err != nil {
+		return ""
+	}
+
+	dir := filepath.Join(strings.TrimSpace(string(output)), "extension")
+	if _, err := os.Stat(dir); err != nil {
+		return ""
+	}
+	return dir
+}
+
+// defaultVersion reads default_version from an extension control file.
+func defaultVersion(controlPath string) string {
+	f, err := os.Open(controlPath)
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if ok && strings.TrimSpace(key) == "default_version" {
+			return strings.Trim(strings.TrimSpace(value), "'")
+		}
+	}
+	return "unknown"
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// restoreGlobals implements --restore-globals: it applies the roles, role
+// memberships and tablespace definitions save --dump-globals recorded to a
+// running server with psql, before a logical restore into it. The data
+// directory is never touched.
+//
+// Roles that already exist on the server make their CREATE ROLE fail, which
+// is expected: the ALTER ROLE after it still brings them up to date. Other
+// errors, such as a tablespace directory missing on the server, are warnings.
+func restoreGlobals(config *Config) error {
+	printMsg(colorGreen, "PostgreSQL Globals Restore")
+	fmt.Println(strings.Repeat("=", 40))
+	fmt.Printf("Backup: %s\n", config.BackupPath)
+
+	cleanup, err := unpackArchive(config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	path := filepath.Join(config.BackupPath, manifest.GlobalsFileName)
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("backup has no %s; it was made without save --dump-globals", manifest.GlobalsFileName)
+	}
+	if m, err := manifest.Read(config.BackupPath); err == nil {
+		if err := m.CheckFiles(config.BackupPath); err != nil {
+			return fmt.Errorf("backup in %s is incomplete: %w", config.BackupPath, err)
+		}
+	}
+
+	var args []string
+	target := "the server psql connects to by default"
+	if config.Host != "" {
+		args = append(args, "-h", config.Host)
+		target = config.Host
+	}
+	if config.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(config.Port))
+		target += ":" + strconv.Itoa(config.Port)
+	}
+	if config.User != "" {
+		args = append(args, "-U", config.User)
+	}
+	args = append(args, "-X", "-q", "-d", config.Database, "-f", path)
+	fmt.Printf("Target: %s\n", target)
+
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would run psql "+strings.Join(args, " "))
+		return nil
+	}
+	if !config.Force {
+		fmt.Printf("\nThis will create roles and tablespaces on %s and reset the passwords of existing roles. Continue? [y/N] ", target)
+		var response string
+		fmt.Scanln(&response)
+		if strings.ToLower(response) != "y" {
+			return fmt.Errorf("restore cancelled by user")
+		}
+	}
+
+	printMsg(colorYellow, "\nApplying "+manifest.GlobalsFileName+"...")
+	cmd := exec.Command("psql", args...)
+	cmd.Stdout = os.Stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to run psql: %w", err)
+	}
+
+	existing, failed := 0, 0
+	var output []string
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.Contains(line, "ERROR:") && strings.Contains(line, "already exists"):
+			existing++
+		case strings.Contains(line, "ERROR:"):
+			failed++
+			warn(line)
+		default:
+			output = append(output, line)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		// psql only fails as a whole when it cannot connect or read the file
+		return fmt.Errorf("psql failed: %w: %s", err, strings.Join(output, "\n"))
+	}
+
+	if existing > 0 {
+		printMsg(colorBlue, fmt.Sprintf("%d roles or tablespaces already existed, their CREATE was skipped", existing))
+	}
+	if failed > 0 {
+		printMsg(colorYellow, fmt.Sprintf("\n%d statements of %s failed, see the warnings above", failed, manifest.GlobalsFileName))
+		return nil
+	}
+	printMsg(colorGreen, "\n✓ Roles and tablespaces applied")
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PostgreSQL 10 renamed the WAL directory from pg_xlog to pg_wal. A server
+// ignores the directory under the other name and cannot find its WAL.
+const (
+	walDirName    = "pg_wal"
+	oldWALDirName = "pg_xlog"
+)
+
+// walDirFor returns the name of the WAL directory PostgreSQL major version
+// pgVersion ("9.6", "16") uses, or "" if pgVersion cannot be parsed.
+func walDirFor(pgVersion string) string {
+	v, err := parseVersion(pgVersion)
+	if err != nil {
+		return ""
+	}
+	if v.major() < 10 {
+		return oldWALDirName
+	}
+	return walDirName
+}
+
+// backupPGVersion returns the PostgreSQL major version of the backup, from
+// its PG_VERSION file or, where that has to be read out of base.tar, from
+// the manifest first.
+func backupPGVersion(config *Config, backupInfo *BackupInfo, recorded string) string {
+	if data, err := os.ReadFile(filepath.Join(config.BackupPath, "PG_VERSION")); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if recorded != "" || backupInfo.Format != "tar" {
+		return recorded
+	}
+	for _, tarFile := range backupInfo.Files {
+		if tarBaseName(tarFile) == "base" {
+			if data, err := readTarMember(tarFile, "PG_VERSION"); err == nil && data != nil {
+				return strings.TrimSpace(string(data))
+			}
+		}
+	}
+	return ""
+}
+
+// backupWALDir returns the name of the WAL directory in the backup: the
+// directory of a plain backup, or the WAL archive of a tar backup
+// (pg_wal.tar, or pg_xlog.tar from older tools). It returns "" if the
+// backup has neither.
+func backupWALDir(config *Config, backupInfo *BackupInfo) string {
+	for _, name := range []string{walDirName, oldWALDirName} {
+		if backupInfo.Format == "tar" {
+			for _, tarFile := range backupInfo.Files {
+				if tarBaseName(tarFile) == name {
+					return name
+				}
+			}
+		} else if _, err := os.Lstat(filepath.Join(config.BackupPath, name)); err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// checkWALLayout checks that the backup's WAL directory has the name its own
+// PG_VERSION and the target's PostgreSQL expect. Unlike a version mismatch
+// this is not allowed with --allow-timescale-version-mismatch: the restored
+// server would not find its WAL whatever else is accepted.
+func checkWALLayout(config *Config, backupInfo *BackupInfo, backupPG, targetPG string) error {
+	found := backupWALDir(config, backupInfo)
+	if found == "" {
+		return nil
+	}
+
+	if expected := walDirFor(backupPG); expected != "" && expected != found {
+		return fmt.Errorf("backup has %s but its PG_VERSION is %s, which uses %s; the backup is inconsistent, check how it was made",
+			found, backupPG, expected)
+	}
+	if expected := walDirFor(targetPG); expected != "" && expected != found {
+		return fmt.Errorf("backup has %s (PostgreSQL %s) but the target PostgreSQL %s expects %s, so the restored server would not find its WAL; restore into the backup's version and upgrade with pg_upgrade",
+			found, layoutVersions(found), targetPG, expected)
+	}
+	return nil
+}
+
+// layoutVersions names the PostgreSQL versions that use the WAL directory
+// name.
+func layoutVersions(name string) string {
+	if name == oldWALDirName {
+		return "9.6 or older"
+	}
+	return "10 or newer"
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+)
+
+// ContentEntry is one member of a backup as shown by --list-contents.
+type ContentEntry struct {
+	Archive string    `json:"archive,omitempty"`
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	Type    string    `json:"type"`
+	ModTime time.Time `json:"mtime"`
+	Link    string    `json:"link,omitempty"`
+}
+
+// listContents prints every member of the backup, like `tar tvf`, without
+// writing anything.
+func listContents(config *Config) error {
+	entries, err := collectContents(config)
+	if err != nil {
+		return err
+	}
+
+	if config.Output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	archive := "\x00"
+	var totalSize int64
+	for _, e := range entries {
+		if e.Archive != archive {
+			archive = e.Archive
+			if archive != "" {
+				printMsg(colorBold, "\n"+archive+":")
+			}
+		}
+
+		line := fmt.Sprintf("%s %12d %s %s", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), e.Path)
+		if e.Link != "" {
+			line += " -> " + e.Link
+		}
+		fmt.Println(line)
+		totalSize += e.Size
+	}
+
+	fmt.Printf("\n%d entries, %s\n", len(entries), formatBytes(totalSize))
+	return nil
+}
+
+func collectContents(config *Config) ([]ContentEntry, error) {
+	info, err := os.Stat(config.BackupPath)
+	if err != nil {
+		return nil, fmt.Errorf("backup path not found: %w", err)
+	}
+
+	if !info.IsDir() && strings.HasSuffix(config.BackupPath, backupfs.ArchiveSuffix) {
+		return listArchive(config.BackupPath)
+	}
+
+	backupInfo, err := detectBackup(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if backupInfo.Format == "plain" {
+		return listPlain(config.BackupPath)
+	}
+
+	var entries []ContentEntry
+	for _, tarFile := range backupInfo.Files {
+		tarReader, err := openTar(tarFile)
+		if err != nil {
+			return nil, err
+		}
+
+		members, err := listTar(tarReader.Reader, filepath.Base(tarFile))
+		tarReader.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", filepath.Base(tarFile), err)
+		}
+		entries = append(entries, members...)
+	}
+	return entries, nil
+}
+
+// listArchive lists a .tar.zst archive made by save --archive-tar, looking
+// inside the PostgreSQL tar files it contains without unpacking them.
+func listArchive(archivePath string) ([]ContentEntry, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	var entries []ContentEntry
+	outer := tar.NewReader(zr)
+	for {
+		header, err := outer.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive header: %w", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		// Members are stored under "<backup name>/"
+		name := header.Name
+		if _, rest, ok := strings.Cut(name, "/"); ok {
+			name = rest
+		}
+
+		// The stream cannot be rewound, but its first bytes can be peeked
+		// at to find renamed tar files without an extension
+		buffered := bufio.NewReaderSize(outer, 1024)
+		compression := compressionFromName(name)
+		if !isTarName(name) {
+			head, _ := buffered.Peek(512)
+			if path.Ext(name) != "" || detectCompression(head) == "" {
+				entries = append(entries, entryFromHeader(header, "", name))
+				continue
+			}
+			compression = detectCompression(head)
+		}
+
+		inner, err := newTarSource(buffered, compression)
+		if err != nil {
+			return nil, err
+		}
+		members, err := listTar(inner.Reader, name)
+		inner.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", name, err)
+		}
+		entries = append(entries, members...)
+	}
+	return entries, nil
+}
+
+func listTar(tarReader *tar.Reader, archive string) ([]ContentEntry, error) {
+	var entries []ContentEntry
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		entries = append(entries, entryFromHeader(header, archive, header.Name))
+	}
+}
+
+func listPlain(backupPath string) ([]ContentEntry, error) {
+	var entries []ContentEntry
+	err := filepath.Walk(backupPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == backupPath {
+			return nil
+		}
+
+		rel, err := filepath.Rel(backupPath, p)
+		if err != nil {
+			return err
+		}
+
+		entry := ContentEntry{
+			Path:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			Mode:    info.Mode().String(),
+			Type:    fileType(info.Mode()),
+			ModTime: info.ModTime(),
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			entry.Link, _ = os.Readlink(p)
+		}
+		if info.IsDir() {
+			entry.Size = 0
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func entryFromHeader(header *tar.Header, archive, name string) ContentEntry {
+	mode := header.FileInfo().Mode()
+	return ContentEntry{
+		Archive: archive,
+		Path:    name,
+		Size:    header.Size,
+		Mode:    mode.String(),
+		Type:    tarType(header.Typeflag),
+		ModTime: header.ModTime,
+		Link:    header.Linkname,
+	}
+}
+
+func tarType(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	default:
+		return "other"
+	}
+}
+
+func fileType(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	default:
+		return "other"
+	}
+}
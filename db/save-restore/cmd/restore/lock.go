@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// lockFileName is the advisory lock restore holds inside the data directory.
+// It lives in the data directory itself so restores running in different
+// containers against the same volume still see each other.
+const lockFileName = ".restore.lock"
+
+// LockInfo is written into the lock file for diagnosis.
+type LockInfo struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// RestoreLock is a held restore lock.
+type RestoreLock struct {
+	file *os.File
+}
+
+// acquireLock takes the restore lock on the data directory, failing fast if
+// another restore holds it. The kernel releases the flock when the holder
+// exits, so a lock file whose flock can be taken was left by a crashed
+// restore; it is only replaced with --force-unlock.
+func acquireLock(config *Config) (*RestoreLock, error) {
+	if err := os.MkdirAll(config.DataDir, config.DataDirMode); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(config.DataDir, lockFileName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	locked, err := tryLock(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	if !locked {
+		holder := readLockInfo(file)
+		file.Close()
+		return nil, fmt.Errorf("another restore is already running on %s (%s)", config.DataDir, holder)
+	}
+
+	if holder := readLockInfo(file); holder != "" {
+		if !config.ForceUnlock {
+			file.Close()
+			return nil, fmt.Errorf("stale restore lock found in %s (%s); the previous restore did not finish, rerun with --force-unlock to override", config.DataDir, holder)
+		}
+		printMsg(colorYellow, fmt.Sprintf("Overriding stale restore lock (%s)", holder))
+	}
+
+	hostname, _ := os.Hostname()
+	info := LockInfo{PID: os.Getpid(), Hostname: hostname, StartedAt: time.Now()}
+	data, err := json.Marshal(info)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write lock file: %w", err)
+	}
+	if _, err := file.WriteAt(append(data, '\n'), 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	return &RestoreLock{file: file}, nil
+}
+
+// Release empties the lock file and drops the lock. The file itself stays:
+// removing it while locked would let a waiting restore lock the deleted file
+// while a later one creates and locks a new one.
+func (l *RestoreLock) Release() {
+	l.file.Truncate(0)
+	l.file.Close()
+}
+
+// readLockInfo describes the holder recorded in the lock file, or returns ""
+// if the file is empty.
+func readLockInfo(file *os.File) string {
+	data, err := io.ReadAll(io.NewSectionReader(file, 0, 1<<20))
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return "unreadable lock file"
+	}
+	return fmt.Sprintf("PID %d on %s, started %s", info.PID, info.Hostname, info.StartedAt.Format(time.RFC3339))
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || dragonfly || netbsd || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on file without waiting. It returns false
+// if another process holds the lock.
+func tryLock(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
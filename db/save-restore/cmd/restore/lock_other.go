@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || dragonfly || netbsd || openbsd)
+
+package main
+
+import "os"
+
+// tryLock is only implemented where syscall.Flock exists; elsewhere only the
+// contents of the lock file guard against overlapping restores, so a running
+// restore is reported as a stale lock.
+func tryLock(file *os.File) (bool, error) {
+	return true, nil
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bytes"
+	"crypto/sha256"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -10,29 +12,87 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/backuplabel"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/report"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
 )
 
 const (
-	colorGreen  = "\033[0;32m"
-	colorYellow = "\033[1;33m"
-	colorRed    = "\033[0;31m"
-	colorBlue   = "\033[0;34m"
-	colorReset  = "\033[0m"
-	colorBold   = "\033[1m"
+	colorGreen  = ui.Green
+	colorYellow = ui.Yellow
+	colorRed    = ui.Red
+	colorBlue   = ui.Blue
+	colorBold   = ui.Bold
 )
 
 type Config struct {
-	BackupPath string
-	DataDir    string
-	DryRun     bool
-	Force      bool
+	BackupPath  string
+	DataDir     string
+	DryRun      bool
+	Force       bool
+	StagingDir  string
+	ForceUnlock bool
+
+	ListContents bool
+	Output       string
+	DataDirMode  os.FileMode
+	ExtensionDir string
+
+	RecoveryTargetTime string
+	RecoveryTargetLSN  string
+	RecoveryTargetName string
+
+	UID       int
+	GID       int
+	ChownOnly bool
+
+	RestoreFiles stringList
+
+	// RestoreGlobals applies the backup's globals.sql to the server given
+	// by Host, Port, User and Database, which default to psql's.
+	RestoreGlobals bool
+	Host           string
+	Port           int
+	User           string
+	Database       string
+
+	WALSegmentSizeMB int
+
+	TargetPGVersion        string
+	TargetTimescaleVersion string
+	AllowTimescaleMismatch bool
+
+	CopyMethod             string
+	HardlinkConsumesBackup bool
+	SyncBefore             bool
+
+	ExtractWorkers   int
+	VerifyAfterWrite bool
+
+	Sentinel string
+	Report   string
+
+	ApprovalCommand string
+
+	TablespaceMap stringList
+
+	WALArchiveDir  string
+	RestoreCommand string
 }
 
 type BackupInfo struct {
-	Format string
-	Files  []string
+	Format      string
+	Files       []string
+	Tablespaces []*tablespaceTarget
 }
 
 func main() {
@@ -41,44 +101,190 @@ func main() {
 	if err := run(config); err != nil {
 		log.Fatal(err)
 	}
+	if err := ui.StrictError(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func parseFlags() *Config {
 	config := &Config{}
 
-	flag.StringVar(&config.BackupPath, "backup", "", "Path to backup directory (required)")
+	flag.StringVar(&config.BackupPath, "backup", "", "Path to backup directory or .tar.zst archive (required)")
 	flag.StringVar(&config.DataDir, "data-dir", "/var/lib/postgresql/data", "PostgreSQL data directory")
 	flag.BoolVar(&config.DryRun, "dry-run", false, "Dry run mode")
 	flag.BoolVar(&config.Force, "force", false, "Skip confirmation prompt")
+	flag.BoolVar(&config.ForceUnlock, "force-unlock", false, "Override a stale restore lock left by a crashed restore")
+	flag.StringVar(&config.StagingDir, "staging-dir", "", "Directory to unpack .tar.zst archives into (default: system temp dir)")
+
+	flag.StringVar(&config.ExtensionDir, "extension-dir", "", "Extension directory of the target PostgreSQL (default: from pg_config)")
+	flag.BoolVar(&config.ListContents, "list-contents", false, "List the files in the backup without restoring")
+	flag.StringVar(&config.Output, "output", "text", "Output format for --list-contents (text or json)")
+
+	flag.StringVar(&config.RecoveryTargetTime, "recovery-target-time", "", "Recover up to this timestamp instead of the end of the backup")
+	flag.StringVar(&config.RecoveryTargetLSN, "recovery-target-lsn", "", "Recover up to this WAL location")
+	flag.StringVar(&config.RecoveryTargetName, "recovery-target-name", "", "Recover up to this restore point created with pg_create_restore_point()")
+
+	// PostgreSQL runs as UID/GID 999 in the official container images
+	flag.IntVar(&config.UID, "uid", 999, "User ID to own the restored files")
+	flag.IntVar(&config.GID, "gid", 999, "Group ID to own the restored files")
+	flag.BoolVar(&config.ChownOnly, "chown-only", false, "Only fix ownership of an existing data directory, without restoring")
+
+	flag.Var(&config.RestoreFiles, "restore-file", "Stage only this data directory file from the backup, without touching the data directory (repeatable)")
+	flag.BoolVar(&config.RestoreGlobals, "restore-globals", false, "Only apply the backup's "+manifest.GlobalsFileName+" (save --dump-globals) to a server with psql, without touching the data directory")
+	flag.StringVar(&config.Host, "host", "", "Server for --restore-globals (default: PGHOST or psql's default)")
+	flag.IntVar(&config.Port, "port", 0, "Port for --restore-globals (default: PGPORT or 5432)")
+	flag.StringVar(&config.User, "user", "", "User for --restore-globals, which needs CREATEROLE or superuser (default: PGUSER)")
+	flag.StringVar(&config.Database, "database", "postgres", "Database psql connects to for --restore-globals")
+
+	flag.IntVar(&config.WALSegmentSizeMB, "wal-segment-size", 0, "Expected WAL segment size in MB, as given to initdb --wal-segsize; restore aborts if the backup's differs (default: no check)")
+
+	flag.StringVar(&config.TargetPGVersion, "target-pg-version", "", "PostgreSQL major version of the target (default: from pg_config)")
+	flag.StringVar(&config.TargetTimescaleVersion, "target-timescale-version", "", "TimescaleDB version of the target (default: from the extension directory)")
+	flag.BoolVar(&config.AllowTimescaleMismatch, "allow-timescale-version-mismatch", false, "Restore even if the TimescaleDB versions are not compatible; a different PostgreSQL major version is always refused")
+
+	flag.StringVar(&config.CopyMethod, "copy-method", copyMethodCopy, "How to restore plain backups: copy, reflink or hardlink (falls back to copy)")
+	flag.BoolVar(&config.HardlinkConsumesBackup, "hardlink-consumes-backup", false, "Accept that --copy-method hardlink gives the backup's files to the restored cluster, which changes them")
+
+	flag.StringVar(&config.Sentinel, "sentinel", "", "Write a JSON completion marker to this path once a full restore succeeded, removing any old one at the start")
+	flag.StringVar(&config.Report, "report", "", "Write an HTML summary of the restore to this path, e.g. restore-report.html; must be outside the data directory")
+	flag.StringVar(&config.ApprovalCommand, "approval-command", "", "Shell command that gets the restore plan as JSON on stdin and must exit 0 to approve; replaces the prompt")
+	flag.IntVar(&config.ExtractWorkers, "extract-workers", 1, "Number of tar files of a tar backup to extract at once")
+	flag.BoolVar(&config.VerifyAfterWrite, "verify-after-write", false, "Sync each file extracted from a tar backup and read it back to check it was stored correctly (slow)")
+	flag.BoolVar(&config.SyncBefore, "sync-before", false, "Sync and drop the page cache before restoring, for benchmarks")
+	flag.StringVar(&config.WALArchiveDir, "wal-archive-dir", "", "WAL archive point-in-time recovery reads from, as the server sees it (default: the one recorded by save --wal-archive-dir)")
+	flag.StringVar(&config.RestoreCommand, "restore-command", "", "restore_command for point-in-time recovery, written as given with its %f and %p placeholders, instead of copying from --wal-archive-dir")
+	flag.Var(&config.TablespaceMap, "tablespace-map", "Restore a tablespace of a tar backup to NEW instead of its original location, as OLD=NEW with OLD its OID, name or location (repeatable)")
+
+	dataDirMode := flag.String("data-dir-mode", "0700", "Permission mode for the data directory and extracted directories (0700 or 0750)")
+
+	ui.AddColorFlag(flag.CommandLine)
+
+	ui.AddStrictFlag(flag.CommandLine)
 
 	flag.Parse()
 
-	if config.BackupPath == "" {
+	mode, err := parseDataDirMode(*dataDirMode)
+	config.DataDirMode = mode
+
+	if err := errors.Join(err, config.Validate()); err != nil {
 		flag.Usage()
-		log.Fatal("Error: --backup flag is required")
+		log.Fatal("Error: invalid configuration:\n" + err.Error())
 	}
 
 	return config
 }
 
-func run(config *Config) error {
+func run(config *Config) (err error) {
+	if config.ListContents {
+		return listContents(config)
+	}
+
+	// Work on the real data directory, not a symlink to it
+	if err := resolveDataDir(config); err != nil {
+		return err
+	}
+	if err := checkReportPath(config); err != nil {
+		return err
+	}
+
+	if config.ChownOnly {
+		return chownOnly(config)
+	}
+	if len(config.RestoreFiles) > 0 {
+		return restoreFiles(config)
+	}
+	if config.RestoreGlobals {
+		return restoreGlobals(config)
+	}
+	if err := clearSentinel(config); err != nil {
+		return err
+	}
+
 	printMsg(colorGreen, "PostgreSQL Cluster Restore (Docker)")
 	fmt.Println(strings.Repeat("=", 40))
 	fmt.Printf("Backup: %s\n", config.BackupPath)
+	source := config.BackupPath
+
+	// The report covers failed restores too
+	timeline := report.NewTimeline()
+	var summary *restoreSummary
+	defer func() {
+		writeReport(config, source, timeline, summary, err)
+	}()
 	fmt.Printf("Target: %s\n", config.DataDir)
 
+	if err := checkBackupOutsideDataDir(config); err != nil {
+		return err
+	}
+
 	if config.DryRun {
 		printMsg(colorYellow, "DRY RUN MODE - No changes will be made")
 	}
 
+	// Unpack single-file archives before looking at the backup
+	cleanup, err := unpackArchive(config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if config.BackupPath != source {
+		timeline.Mark("Unpack archive")
+	}
+
 	// Check prerequisites
 	backupInfo, err := checkPrerequisites(config)
 	if err != nil {
 		return err
 	}
 
-	// Confirm with user
-	if !config.Force && !config.DryRun {
+	// Show which point in time is about to be restored
+	showBackupLabel(config, backupInfo)
+
+	// Make sure the target binaries provide the backup's extensions
+	checkExtensions(config)
+
+	// Refuse version combinations known to break the restored cluster
+	if err := checkCompatibility(config, backupInfo); err != nil {
+		return err
+	}
+	if err := checkRecoverySupport(config, backupInfo); err != nil {
+		return err
+	}
+
+	// Refuse a backup whose WAL segment size is not the expected one
+	if err := checkWALSegmentSize(config); err != nil {
+		return err
+	}
+
+	// Decide where tablespace archives go before anything is removed
+	if backupInfo.Format == "tar" {
+		if backupInfo.Tablespaces, err = planTablespaces(config, backupInfo); err != nil {
+			return err
+		}
+	}
+
+	// Paths too long to create would only fail halfway through extracting
+	if err := checkPathRoots(config, backupInfo); err != nil {
+		return err
+	}
+
+	// Options that do not apply to this backup are warnings too
+	checkCopyMethod(config, backupInfo)
+
+	// With --strict, any warning so far stops the restore before it
+	// destroys the current data
+	if err := ui.StrictError(); err != nil {
+		return err
+	}
+	timeline.Mark("Checks")
+
+	// Confirm with user, or with the approval command instead, which
+	// --force does not skip
+	if config.ApprovalCommand != "" {
+		if err := requestApproval(config, buildPlan(config, source, backupInfo)); err != nil {
+			return err
+		}
+	} else if !config.Force && !config.DryRun {
 		fmt.Print("\nThis will DESTROY all current data. Continue? [y/N] ")
 		var response string
 		fmt.Scanln(&response)
@@ -87,41 +293,90 @@ func run(config *Config) error {
 		}
 	}
 
+	timeline.Mark("Confirmation")
+
+	// Make sure no other restore is working on the same data directory
+	if !config.DryRun {
+		lock, err := acquireLock(config)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	// Start from a cold page cache when benchmarking
+	if config.SyncBefore {
+		syncBefore(config)
+	}
+
 	// Clear data directory
 	if err := clearDataDirectory(config); err != nil {
 		return err
 	}
+	timeline.Mark("Clear data directory")
 
 	// Restore from backup
 	printMsg(colorGreen, "\nRestoring from backup...")
+	restoreStart := time.Now()
 	if err := restoreBackup(config, backupInfo); err != nil {
 		return err
 	}
+	timeline.Mark("Extraction")
 
-	// Set permissions
-	if err := setPermissions(config); err != nil {
+	// Point-in-time recovery needs backup_label and replays WAL on startup
+	pitr, _ := recoveryTarget(config)
+	if err := configureRecovery(config); err != nil {
 		return err
 	}
 
-	// Remove recovery files
-	if err := removeRecoveryFiles(config); err != nil {
+	// Set permissions
+	if err := setPermissions(config); err != nil {
 		return err
 	}
 
-	// Check if WAL reset is needed
-	if err := checkAndResetWAL(config); err != nil {
-		return err
+	if pitr == "" {
+		// Remove recovery files
+		if err := removeRecoveryFiles(config); err != nil {
+			return err
+		}
+
+		// Check if WAL reset is needed
+		if err := checkAndResetWAL(config); err != nil {
+			return err
+		}
 	}
 
+	timeline.Mark("Configuration")
+
+	// Flush everything to disk so the restore time is honest
+	syncTime := syncAfter(config)
+	restoreTime := time.Since(restoreStart)
+	timeline.Mark("Sync")
+
+	// Make sure the restored cluster keeps the source's data checksums
+	checkDataChecksums(config)
+	timeline.Mark("Checksums")
+
 	// Report summary
-	if err := reportSummary(config); err != nil {
+	summary, err = reportSummary(config, restoreTime, syncTime)
+	if err != nil {
 		return err
 	}
+	timeline.Mark("Summary")
 
 	printMsg(colorGreen, "\n✓ Restore completed successfully!")
 	printMsg(colorYellow, "\nNote: You need to restart the PostgreSQL container to use the restored data")
+	if pitr != "" {
+		printMsg(colorYellow, "The server will replay WAL up to the recovery target on startup; do not run pg_resetwal on this data directory")
+	}
 
-	return nil
+	if summary != nil {
+		summary.Backup = source
+		summary.RecoveryTarget = pitr
+		describeSource(config, backupInfo, summary)
+		summary.Phases = timeline.Phases()
+	}
+	return writeSentinel(config, summary)
 }
 
 func checkPrerequisites(config *Config) (*BackupInfo, error) {
@@ -130,6 +385,22 @@ func checkPrerequisites(config *Config) (*BackupInfo, error) {
 		return nil, fmt.Errorf("this tool must be run as root for Docker restore")
 	}
 
+	backupInfo, err := detectBackup(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if backupInfo.Format == "tar" {
+		printMsg(colorGreen, "✓ Found tar format backup")
+	} else {
+		printMsg(colorGreen, "✓ Found plain format backup")
+	}
+
+	return backupInfo, nil
+}
+
+// detectBackup determines the format of the backup in config.BackupPath.
+func detectBackup(config *Config) (*BackupInfo, error) {
 	// Check backup path
 	info, err := os.Stat(config.BackupPath)
 	if err != nil {
@@ -144,29 +415,91 @@ func checkPrerequisites(config *Config) (*BackupInfo, error) {
 	backupInfo := &BackupInfo{}
 	
 	// Check for tar files
-	tarFiles, _ := filepath.Glob(filepath.Join(config.BackupPath, "*.tar.gz"))
-	if len(tarFiles) == 0 {
-		tarFiles, _ = filepath.Glob(filepath.Join(config.BackupPath, "*.tar"))
-	}
+	tarFiles := findBackupTars(config.BackupPath)
 
 	if len(tarFiles) > 0 {
+		if err := checkVolumes(config, tarFiles); err != nil {
+			return nil, err
+		}
 		backupInfo.Format = "tar"
 		backupInfo.Files = tarFiles
-		printMsg(colorGreen, "✓ Found tar format backup")
 	} else {
 		// Check for plain format
 		pgVersionFile := filepath.Join(config.BackupPath, "PG_VERSION")
 		if _, err := os.Stat(pgVersionFile); err == nil {
 			backupInfo.Format = "plain"
-			printMsg(colorGreen, "✓ Found plain format backup")
 		} else {
 			return nil, fmt.Errorf("no valid backup found in %s", config.BackupPath)
 		}
 	}
 
+	// Refuse a backup whose files do not match its manifest, e.g. one
+	// copied away before it was finished
+	if m, err := manifest.Read(config.BackupPath); err == nil {
+		if err := m.CheckFiles(config.BackupPath); err != nil {
+			return nil, fmt.Errorf("backup in %s is incomplete: %w", config.BackupPath, err)
+		}
+	}
+
 	return backupInfo, nil
 }
 
+// parseDataDirMode parses an octal --data-dir-mode value. Validate checks
+// that it is a mode PostgreSQL accepts.
+func parseDataDirMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid --data-dir-mode %q: must be an octal mode such as 0700", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// showBackupLabel prints the backup_label of the backup so the operator sees
+// exactly which point in time they are about to restore.
+func showBackupLabel(config *Config, backupInfo *BackupInfo) {
+	label, err := readBackupLabel(config, backupInfo)
+	if err != nil {
+		warn("Could not read backup_label: " + err.Error())
+		return
+	}
+
+	fmt.Println("\n" + ui.Colorize(colorBold, "Backup label:"))
+	label.Print(os.Stdout, "  ")
+}
+
+func readBackupLabel(config *Config, backupInfo *BackupInfo) (*backuplabel.Label, error) {
+	if backupInfo.Format == "plain" {
+		return backuplabel.ReadFile(filepath.Join(config.BackupPath, backuplabel.FileName))
+	}
+
+	for _, tarFile := range backupInfo.Files {
+		if tarBaseName(tarFile) != "base" {
+			continue
+		}
+
+		tarReader, err := openTar(tarFile)
+		if err != nil {
+			return nil, err
+		}
+		defer tarReader.Close()
+
+		for {
+			header, err := tarReader.Next()
+			if err == io.EOF {
+				return nil, fmt.Errorf("%s not found in %s", backuplabel.FileName, filepath.Base(tarFile))
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read tar header: %w", err)
+			}
+			if strings.TrimPrefix(header.Name, "./") == backuplabel.FileName {
+				return backuplabel.Parse(tarReader)
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("base.tar not found")
+}
+
 func clearDataDirectory(config *Config) error {
 	if config.DryRun {
 		printMsg(colorYellow, "DRY RUN: Would clear data directory")
@@ -193,7 +526,7 @@ func clearDataDirectory(config *Config) error {
 		return fmt.Errorf("failed to read data directory: %w", err)
 	}
 
-	if len(entries) == 0 {
+	if len(entries) == 0 || (len(entries) == 1 && entries[0].Name() == lockFileName) {
 		printMsg(colorGreen, "Data directory is empty")
 		return nil
 	}
@@ -209,6 +542,9 @@ func clearDataDirectory(config *Config) error {
 	}
 
 	for _, entry := range entries {
+		if entry.Name() == lockFileName {
+			continue
+		}
 		path := filepath.Join(config.DataDir, entry.Name())
 		if err := os.RemoveAll(path); err != nil {
 			return fmt.Errorf("failed to remove %s: %w", path, err)
@@ -216,7 +552,7 @@ func clearDataDirectory(config *Config) error {
 	}
 
 	// Ensure proper permissions on the now-empty directory
-	if err := os.Chmod(config.DataDir, 0700); err != nil {
+	if err := os.Chmod(config.DataDir, config.DataDirMode); err != nil {
 		return fmt.Errorf("failed to set directory permissions: %w", err)
 	}
 
@@ -234,6 +570,9 @@ func restoreBackup(config *Config, backupInfo *BackupInfo) error {
 	case "tar":
 		return extractTarBackup(config, backupInfo)
 	case "plain":
+		if config.CopyMethod != copyMethodCopy {
+			return linkPlainBackup(config)
+		}
 		return copyPlainBackup(config)
 	default:
 		return fmt.Errorf("unknown backup format: %s", backupInfo.Format)
@@ -243,86 +582,225 @@ func restoreBackup(config *Config, backupInfo *BackupInfo) error {
 func extractTarBackup(config *Config, backupInfo *BackupInfo) error {
 	printMsg(colorYellow, "\nExtracting tar backup files...")
 
+	tablespaces := map[string]*tablespaceTarget{}
+	for _, t := range backupInfo.Tablespaces {
+		tablespaces[t.Archive] = t
+	}
+
+	type job struct{ tarFile, dest string }
+	var jobs []job
 	for _, tarFile := range backupInfo.Files {
 		baseName := filepath.Base(tarFile)
-		printMsg(colorBlue, fmt.Sprintf("Extracting: %s", baseName))
-
-		// Open tar file
-		file, err := os.Open(tarFile)
-		if err != nil {
-			return fmt.Errorf("failed to open tar file: %w", err)
-		}
-		defer file.Close()
 
-		// Handle gzip compression
-		var tarReader *tar.Reader
-		if strings.HasSuffix(tarFile, ".gz") {
-			gzReader, err := gzip.NewReader(file)
-			if err != nil {
-				return fmt.Errorf("failed to create gzip reader: %w", err)
+		// base.tar is the data directory, pg_wal.tar its pg_wal (pg_xlog.tar
+		// its pg_xlog before PostgreSQL 10) and every other archive a
+		// tablespace restored at its own location
+		dest := config.DataDir
+		if tarBaseName(baseName) == walDirName {
+			dest = filepath.Join(config.DataDir, walDirName)
+		} else if tarBaseName(baseName) == oldWALDirName {
+			dest = filepath.Join(config.DataDir, oldWALDirName)
+		} else if t, ok := tablespaces[tarFile]; ok {
+			dest = t.Location
+			if t.Replace {
+				if err := os.RemoveAll(filepath.Join(dest, t.VersionDir)); err != nil {
+					return fmt.Errorf("failed to clear tablespace %s: %w", t.OID, err)
+				}
 			}
-			defer gzReader.Close()
-			tarReader = tar.NewReader(gzReader)
-		} else {
-			tarReader = tar.NewReader(file)
 		}
+		jobs = append(jobs, job{tarFile, dest})
+	}
 
-		// Extract files
-		fileCount := 0
-		for {
-			header, err := tarReader.Next()
-			if err == io.EOF {
-				break
-			}
-			if err != nil {
-				return fmt.Errorf("failed to read tar header: %w", err)
+	// Each tar is a stream read from start to end, but the tars go to
+	// separate directories and can be extracted side by side
+	workers := min(config.ExtractWorkers, len(jobs))
+	if workers > 1 {
+		printMsg(colorBlue, fmt.Sprintf("Extracting %d tar files with %d workers", len(jobs), workers))
+	}
+	var (
+		next   atomic.Int64
+		counts extractCounts
+		failed atomic.Bool
+		mu     sync.Mutex
+		errs   []error
+		wg     sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Stop taking new tars once one has failed
+			for !failed.Load() {
+				i := int(next.Add(1)) - 1
+				if i >= len(jobs) {
+					return
+				}
+				baseName := filepath.Base(jobs[i].tarFile)
+				printMsg(colorBlue, fmt.Sprintf("Extracting: %s → %s", baseName, jobs[i].dest))
+				if err := extractTar(config, jobs[i].tarFile, jobs[i].dest, &counts); err != nil {
+					failed.Store(true)
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("failed to extract %s: %w", baseName, err))
+					mu.Unlock()
+					continue
+				}
+				printMsg(colorGreen, fmt.Sprintf("✓ Extracted %s", baseName))
 			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
 
-			// Construct full path
-			targetPath := filepath.Join(config.DataDir, header.Name)
+	if err := linkTablespaces(config, backupInfo.Tablespaces); err != nil {
+		return err
+	}
 
-			// Create directory if needed
-			if header.Typeflag == tar.TypeDir {
-				if err := os.MkdirAll(targetPath, 0700); err != nil {
-					return fmt.Errorf("failed to create directory: %w", err)
-				}
-				continue
-			}
+	printMsg(colorGreen, fmt.Sprintf("✓ All tar files extracted (%d files)", counts.files.Load()))
+	if config.VerifyAfterWrite {
+		printMsg(colorGreen, fmt.Sprintf("✓ Read back and verified %s after writing", formatBytes(counts.verified.Load())))
+	}
+	return nil
+}
 
-			// Create parent directory
-			parentDir := filepath.Dir(targetPath)
-			if err := os.MkdirAll(parentDir, 0700); err != nil {
-				return fmt.Errorf("failed to create parent directory: %w", err)
-			}
+// verifyWrittenFile syncs f, drops it from the page cache and reads it back,
+// so that a disk returning something other than what was written is caught
+// now rather than when PostgreSQL reads the page.
+func verifyWrittenFile(f *os.File, sum []byte) error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync: %w", err)
+	}
+	if err := evictFile(f); err != nil {
+		return fmt.Errorf("failed to drop from the page cache: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reread := sha256.New()
+	if _, err := io.Copy(reread, f); err != nil {
+		return fmt.Errorf("failed to read back: %w", err)
+	}
+	if !bytes.Equal(reread.Sum(nil), sum) {
+		return fmt.Errorf("contents differ from what was written; the storage may be failing")
+	}
+	return nil
+}
 
-			// Extract file
-			outFile, err := os.Create(targetPath)
-			if err != nil {
-				return fmt.Errorf("failed to create file: %w", err)
+// extractCounts are the totals of all extraction workers together.
+type extractCounts struct {
+	files    atomic.Int64
+	verified atomic.Int64 // bytes read back with --verify-after-write
+}
+
+// extractTar extracts tarFile into dest, recreating symlinks and hard links.
+func extractTar(config *Config, tarFile, dest string, counts *extractCounts) error {
+	tarReader, err := openTar(tarFile)
+	if err != nil {
+		return err
+	}
+	defer tarReader.Close()
+
+	if err := os.MkdirAll(dest, config.DataDirMode); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	destDir, err := backupfs.NewDest(dest)
+	if err != nil {
+		return err
+	}
+
+	// Extract files
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		// Construct full path
+		targetPath, skip, err := destDir.Member(header)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		if err := checkMemberPath(header.Name, targetPath); err != nil {
+			return err
+		}
+
+		// Create directory if needed
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(targetPath, config.DataDirMode); err != nil {
+				return fmt.Errorf("failed to create directory: %w", describePathError(header.Name, targetPath, err))
 			}
+			continue
+		}
 
-			if _, err := io.Copy(outFile, tarReader); err != nil {
-				outFile.Close()
-				return fmt.Errorf("failed to extract file: %w", err)
+		// Create parent directory
+		parentDir := filepath.Dir(targetPath)
+		if err := os.MkdirAll(parentDir, config.DataDirMode); err != nil {
+			return fmt.Errorf("failed to create parent directory: %w", describePathError(header.Name, targetPath, err))
+		}
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			os.Remove(targetPath)
+			if err := os.Symlink(header.Linkname, targetPath); err != nil {
+				return fmt.Errorf("failed to create symlink: %w", err)
+			}
+			continue
+		case tar.TypeLink:
+			// A hard link shares the file it names, which must come from
+			// this archive too; Member checked that it does
+			linkTarget := filepath.Join(dest, header.Linkname)
+			os.Remove(targetPath)
+			if err := os.Link(linkTarget, targetPath); err != nil {
+				return fmt.Errorf("failed to create hard link: %w", err)
 			}
+			continue
+		case tar.TypeReg:
+		default:
+			// Devices and FIFOs have no place in a data directory
+			continue
+		}
+
+		// Extract file
+		outFile, err := os.Create(targetPath)
+		if err != nil {
+			return fmt.Errorf("failed to create file: %w", describePathError(header.Name, targetPath, err))
+		}
 
+		written := sha256.New()
+		var w io.Writer = outFile
+		if config.VerifyAfterWrite {
+			w = io.MultiWriter(outFile, written)
+		}
+		if _, err := io.Copy(w, tarReader); err != nil {
 			outFile.Close()
+			return fmt.Errorf("failed to extract file: %w", err)
+		}
 
-			// Set file permissions
-			if err := os.Chmod(targetPath, os.FileMode(header.Mode)); err != nil {
-				return fmt.Errorf("failed to set file permissions: %w", err)
+		if config.VerifyAfterWrite {
+			if err := verifyWrittenFile(outFile, written.Sum(nil)); err != nil {
+				outFile.Close()
+				return fmt.Errorf("%s: %w", header.Name, err)
 			}
+			counts.verified.Add(header.Size)
+		}
+		outFile.Close()
 
-			fileCount++
-			if fileCount%100 == 0 {
-				printMsg(colorBlue, fmt.Sprintf("  Extracted %d files...", fileCount))
-			}
+		// Set file permissions
+		if err := os.Chmod(targetPath, os.FileMode(header.Mode)); err != nil {
+			return fmt.Errorf("failed to set file permissions: %w", err)
 		}
 
-		printMsg(colorGreen, "Progress: 100%")
+		if n := counts.files.Add(1); n%100 == 0 {
+			printMsg(colorBlue, fmt.Sprintf("  Extracted %d files...", n))
+		}
 	}
-
-	printMsg(colorGreen, "✓ All tar files extracted")
 	return nil
 }
 
@@ -330,15 +808,60 @@ func copyPlainBackup(config *Config) error {
 	printMsg(colorYellow, "\nCopying plain backup files...")
 
 	// Use rsync or cp to copy files
-	cmd := exec.Command("cp", "-a", filepath.Join(config.BackupPath, "."), config.DataDir)
+	// filepath.Join would drop the trailing "." and copy the backup
+	// directory itself into the data directory
+	cmd := exec.Command("cp", "-a", config.BackupPath+"/.", config.DataDir)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to copy backup: %w\nOutput: %s", err, output)
 	}
 
+	// The save tool's metadata files are not part of the data directory
+	for _, name := range manifest.MetadataFiles {
+		if err := os.Remove(filepath.Join(config.DataDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove %s: %w", name, err)
+		}
+	}
+
+	// cp -a carries over the backup directory's own mode
+	if err := os.Chmod(config.DataDir, config.DataDirMode); err != nil {
+		return fmt.Errorf("failed to set directory permissions: %w", err)
+	}
+
 	printMsg(colorGreen, "✓ Plain backup copied")
 	return nil
 }
 
+// chownOnly runs just the ownership step over an already restored data
+// directory, for when the files ended up with the wrong owner.
+func chownOnly(config *Config) error {
+	printMsg(colorGreen, "PostgreSQL Data Directory Ownership Fix")
+	fmt.Println(strings.Repeat("=", 40))
+	fmt.Printf("Target: %s\n", config.DataDir)
+
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("this tool must be run as root to change ownership")
+	}
+
+	pgControlPath := filepath.Join(config.DataDir, "global", "pg_control")
+	if _, err := os.Stat(pgControlPath); err != nil {
+		return fmt.Errorf("%s is not a PostgreSQL data directory (global/pg_control not found)", config.DataDir)
+	}
+
+	if !config.DryRun {
+		lock, err := acquireLock(config)
+		if err != nil {
+			return err
+		}
+		defer lock.Release()
+	}
+
+	return setPermissions(config)
+}
+
+// chownProgressInterval is how many entries setPermissions changes between
+// progress messages.
+const chownProgressInterval = 5000
+
 func setPermissions(config *Config) error {
 	if config.DryRun {
 		printMsg(colorYellow, "DRY RUN: Would set permissions")
@@ -348,29 +871,39 @@ func setPermissions(config *Config) error {
 	printMsg(colorYellow, "\nSetting permissions...")
 	printMsg(colorBlue, "Setting ownership (this may take a while for large databases)...")
 
-	// PostgreSQL runs as UID/GID 999 in the container
-	const postgresUID = 999
-	const postgresGID = 999
+	// Walk through all files and set ownership, including the tablespaces
+	// the pg_tblspc links point to, which filepath.Walk does not follow
+	roots := []string{config.DataDir}
+	for target := range linkedTablespaces(config.DataDir) {
+		roots = append(roots, target)
+	}
 
-	// Walk through all files and set ownership
-	err := filepath.Walk(config.DataDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+	count := 0
+	for _, root := range roots {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
 
-		// Set ownership
-		if err := syscall.Chown(path, postgresUID, postgresGID); err != nil {
-			return fmt.Errorf("failed to set ownership on %s: %w", path, err)
-		}
+			// Set ownership
+			if err := syscall.Lchown(path, config.UID, config.GID); err != nil {
+				return fmt.Errorf("failed to set ownership on %s: %w", path, err)
+			}
 
-		return nil
-	})
+			count++
+			if count%chownProgressInterval == 0 {
+				printMsg(colorBlue, fmt.Sprintf("  Chowned %d files...", count))
+			}
 
-	if err != nil {
-		return err
+			return nil
+		})
+
+		if err != nil {
+			return err
+		}
 	}
 
-	printMsg(colorGreen, "✓ Permissions set to postgres:postgres")
+	printMsg(colorGreen, fmt.Sprintf("✓ Ownership set to %d:%d (%d files)", config.UID, config.GID, count))
 	return nil
 }
 
@@ -432,9 +965,9 @@ func checkAndResetWAL(config *Config) error {
 	return nil
 }
 
-func reportSummary(config *Config) error {
+func reportSummary(config *Config, restoreTime, syncTime time.Duration) (*restoreSummary, error) {
 	if config.DryRun {
-		return nil
+		return nil, nil
 	}
 
 	// Calculate restored size
@@ -457,15 +990,25 @@ func reportSummary(config *Config) error {
 	})
 
 	if err != nil {
-		return fmt.Errorf("failed to calculate restore size: %w", err)
+		return nil, fmt.Errorf("failed to calculate restore size: %w", err)
 	}
 
-	fmt.Printf("\n%sRestore Summary:%s\n", colorBold, colorReset)
+	fmt.Println("\n" + ui.Colorize(colorBold, "Restore Summary:"))
 	fmt.Printf("Data directory: %s\n", config.DataDir)
 	fmt.Printf("Restored size: %s\n", formatBytes(totalSize))
 	fmt.Printf("Files: %d, Directories: %d\n", fileCount, dirCount)
+	if seconds := restoreTime.Seconds(); seconds > 0 {
+		fmt.Printf("Restore time: %s including %s final sync (%s/s)\n",
+			restoreTime.Round(time.Millisecond), syncTime.Round(time.Millisecond), formatBytes(int64(float64(totalSize)/seconds)))
+	}
 
-	return nil
+	return &restoreSummary{
+		DataDir:     config.DataDir,
+		Size:        totalSize,
+		Files:       fileCount,
+		Directories: dirCount,
+		Seconds:     restoreTime.Round(time.Millisecond).Seconds(),
+	}, nil
 }
 
 func formatBytes(bytes int64) string {
@@ -482,9 +1025,11 @@ func formatBytes(bytes int64) string {
 }
 
 func printMsg(color, msg string) {
-	if color != "" {
-		fmt.Printf("%s%s%s\n", color, msg, colorReset)
-	} else {
-		fmt.Println(msg)
-	}
+	ui.Println(color, msg)
+}
+
+// warn reports something the operator should look at. --strict turns it
+// into an error (see ui.StrictError).
+func warn(msg string) {
+	ui.Warn(msg)
 }
\ No newline at end of file
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// pathHeadroom is roughly the longest path PostgreSQL creates below a data
+// directory or tablespace location, such as
+// PG_16_202307071/4294967295/4294967295_fsm.4294967295 in a tablespace. The
+// platform's pathMax and nameMax are in the pathlen_*.go files.
+const pathHeadroom = 128
+
+// checkPathRoots checks before anything is cleared that the data directory
+// and the tablespace locations leave room for the paths below them. Paths
+// over the platform's pathMax can be neither extracted nor opened by PostgreSQL.
+func checkPathRoots(config *Config, backupInfo *BackupInfo) error {
+	roots := []string{config.DataDir}
+	for _, t := range backupInfo.Tablespaces {
+		roots = append(roots, t.Location)
+	}
+	for _, root := range roots {
+		// A relative root gets longer once the server resolves it
+		if abs, err := filepath.Abs(root); err == nil {
+			root = abs
+		}
+		if len(root)+pathHeadroom >= pathMax {
+			return fmt.Errorf("%s is %d bytes long; with the up to %d bytes PostgreSQL adds below it, paths would exceed the %d-byte path limit. Restore to a shorter --data-dir or --tablespace-map location",
+				root, len(root), pathHeadroom, pathMax)
+		}
+	}
+	return nil
+}
+
+// checkMemberPath checks that target, where the tar member named member is
+// extracted, is within the platform's path limits.
+func checkMemberPath(member, target string) error {
+	if len(target) >= pathMax {
+		return fmt.Errorf("%s: %s is %d bytes long, over the %d-byte path limit; restore to a shorter --data-dir or --tablespace-map location",
+			member, target, len(target), pathMax)
+	}
+	for _, name := range strings.Split(target, string(filepath.Separator)) {
+		if len(name) > nameMax {
+			return fmt.Errorf("%s: the file name %s is %d bytes long, over the %d-byte limit (NAME_MAX)", member, name, len(name), nameMax)
+		}
+	}
+	return nil
+}
+
+// describePathError explains ENAMETOOLONG from creating target for member,
+// which also comes from filesystems with shorter limits, such as eCryptfs.
+func describePathError(member, target string, err error) error {
+	if errors.Is(err, syscall.ENAMETOOLONG) {
+		return fmt.Errorf("%s: the filesystem refuses %s (%d bytes) as too long; restore to a shorter --data-dir or --tablespace-map location, or to a filesystem with longer names: %w",
+			member, target, len(target), err)
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+package main
+
+const (
+	// pathMax is PATH_MAX on Linux, including the terminating NUL, and
+	// nameMax the longest file name most Linux filesystems take.
+	pathMax = 4096
+	nameMax = 255
+)
@@ -0,0 +1,10 @@
+//go:build !linux && !windows
+
+package main
+
+const (
+	// pathMax is PATH_MAX on macOS, the BSDs and Solaris, including the
+	// terminating NUL, and nameMax their NAME_MAX.
+	pathMax = 1024
+	nameMax = 255
+)
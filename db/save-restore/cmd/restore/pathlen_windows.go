@@ -0,0 +1,8 @@
+package main
+
+const (
+	// pathMax is MAX_PATH, which PostgreSQL on Windows is held to, and
+	// nameMax the longest file name NTFS takes.
+	pathMax = 260
+	nameMax = 255
+)
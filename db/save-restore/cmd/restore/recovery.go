@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// maxRestorePointName is the longest name pg_create_restore_point() accepts.
+const maxRestorePointName = 63
+
+var lsnRe = regexp.MustCompile(`^[0-9A-Fa-f]{1,8}/[0-9A-Fa-f]{1,8}$`)
+
+// recoverySignalVersion is the first PostgreSQL major version that reads
+// the recovery settings from postgresql.conf and starts recovery for
+// recovery.signal. Older versions take both from recovery.conf.
+const recoverySignalVersion = 12
+
+// recoveryTarget returns the recovery_target_* setting requested on the
+// command line and its value, or an empty setting for a plain restore.
+func recoveryTarget(config *Config) (setting, value string) {
+	switch {
+	case config.RecoveryTargetTime != "":
+		return "recovery_target_time", config.RecoveryTargetTime
+	case config.RecoveryTargetLSN != "":
+		return "recovery_target_lsn", config.RecoveryTargetLSN
+	case config.RecoveryTargetName != "":
+		return "recovery_target_name", config.RecoveryTargetName
+	}
+	return "", ""
+}
+
+// validateRecoveryTarget checks that at most one recovery target was given
+// and that it is well formed.
+func validateRecoveryTarget(config *Config) error {
+	set := 0
+	for _, v := range []string{config.RecoveryTargetTime, config.RecoveryTargetLSN, config.RecoveryTargetName} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("--recovery-target-time, --recovery-target-lsn and --recovery-target-name are mutually exclusive")
+	}
+
+	if config.RecoveryTargetLSN != "" && !lsnRe.MatchString(config.RecoveryTargetLSN) {
+		return fmt.Errorf("invalid --recovery-target-lsn %q: expected the form 0/3000060", config.RecoveryTargetLSN)
+	}
+	if len(config.RecoveryTargetName) > maxRestorePointName {
+		return fmt.Errorf("--recovery-target-name is longer than %d bytes, the limit for restore point names", maxRestorePointName)
+	}
+	return nil
+}
+
+// checkRecoverySupport refuses a recovery target the backup's PostgreSQL
+// version does not know, before anything is removed. recovery_target_lsn
+// was added in PostgreSQL 10. A version that cannot be determined is left
+// to the server.
+func checkRecoverySupport(config *Config, backupInfo *BackupInfo) error {
+	setting, _ := recoveryTarget(config)
+	if setting != "recovery_target_lsn" {
+		return nil
+	}
+	var recorded string
+	if m, err := manifest.Read(config.BackupPath); err == nil {
+		recorded = m.PGVersion
+	}
+	pgVersion := backupPGVersion(config, backupInfo, recorded)
+	if v, err := parseVersion(pgVersion); err == nil && v.major() < 10 {
+		return fmt.Errorf("--recovery-target-lsn needs PostgreSQL 10 or later, but the backup is from PostgreSQL %s; use --recovery-target-time or --recovery-target-name", pgVersion)
+	}
+	return nil
+}
+
+// configureRecovery sets the restored cluster up for point-in-time recovery:
+// the recovery target goes into postgresql.auto.conf and recovery.signal makes
+// the server start in targeted recovery, or both go into recovery.conf
+// before PostgreSQL 12. backup_label stays in place so the server knows
+// where replay has to begin.
+func configureRecovery(config *Config) error {
+	setting, value := recoveryTarget(config)
+	if setting == "" {
+		return nil
+	}
+
+	if config.DryRun {
+		printMsg(colorYellow, fmt.Sprintf("DRY RUN: Would configure recovery with %s = '%s'", setting, value))
+		return nil
+	}
+
+	printMsg(colorYellow, "\nConfiguring point-in-time recovery...")
+
+	data, err := os.ReadFile(filepath.Join(config.DataDir, "PG_VERSION"))
+	if err != nil {
+		return fmt.Errorf("failed to read PG_VERSION: %w", err)
+	}
+	if v, err := parseVersion(strings.TrimSpace(string(data))); err == nil && v.major() < recoverySignalVersion {
+		return writeRecoveryConf(config, setting, value)
+	}
+
+	autoConf := filepath.Join(config.DataDir, "postgresql.auto.conf")
+	f, err := os.OpenFile(autoConf, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open postgresql.auto.conf: %w", err)
+	}
+	line := fmt.Sprintf("\n# Added by restore\n%s = %s\n", setting, quoteConfValue(value))
+	command, source := restoreCommand(config)
+	if command != "" {
+		line += fmt.Sprintf("restore_command = %s\n", quoteConfValue(command))
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write postgresql.auto.conf: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write postgresql.auto.conf: %w", err)
+	}
+
+	signal := filepath.Join(config.DataDir, "recovery.signal")
+	if err := os.WriteFile(signal, nil, 0600); err != nil {
+		return fmt.Errorf("failed to create recovery.signal: %w", err)
+	}
+
+	reportRecovery(setting, value, command, source)
+	return nil
+}
+
+// writeRecoveryConf writes recovery.conf for PostgreSQL 11 and older, whose
+// presence starts recovery. Without standby_mode those versions refuse to
+// start unless restore_command is set, so without a WAL archive it is one
+// that always fails: the server then only replays the WAL in pg_wal, as
+// PostgreSQL 12 and later do without restore_command.
+func writeRecoveryConf(config *Config, setting, value string) error {
+	command, source := restoreCommand(config)
+	restoreCmd := command
+	if restoreCmd == "" {
+		restoreCmd = "false"
+	}
+
+	conf := fmt.Sprintf("# Added by restore\nstandby_mode = off\nrestore_command = %s\n%s = %s\n",
+		quoteConfValue(restoreCmd), setting, quoteConfValue(value))
+	if err := os.WriteFile(filepath.Join(config.DataDir, "recovery.conf"), []byte(conf), 0600); err != nil {
+		return fmt.Errorf("failed to write recovery.conf: %w", err)
+	}
+
+	reportRecovery(setting, value, command, source)
+	return nil
+}
+
+func reportRecovery(setting, value, command, source string) {
+	printMsg(colorGreen, fmt.Sprintf("✓ Recovery target set: %s = '%s'", setting, value))
+	if command != "" {
+		printMsg(colorGreen, "✓ WAL past the end of the backup is read "+source)
+	} else {
+		warn("No WAL archive (--wal-archive-dir or --restore-command), recovery can only replay the WAL in the backup")
+	}
+}
+
+// restoreCommand returns the restore_command for recovery and where it reads
+// WAL from, for the summary: --restore-command as given, else one copying
+// from the WAL archive, else none.
+func restoreCommand(config *Config) (command, source string) {
+	if config.RestoreCommand != "" {
+		return config.RestoreCommand, "with --restore-command"
+	}
+	if archive := walArchive(config); archive != "" {
+		return archiveRestoreCommand(archive), "from " + archive
+	}
+	return "", ""
+}
+
+// walArchive returns the WAL archive recovery reads from: --wal-archive-dir,
+// else the one recorded in the manifest when it exists on this host.
+func walArchive(config *Config) string {
+	if config.WALArchiveDir != "" {
+		return config.WALArchiveDir
+	}
+	m, err := manifest.Read(config.BackupPath)
+	if err != nil || m.WALArchive == "" {
+		return ""
+	}
+	if info, err := os.Stat(m.WALArchive); err != nil || !info.IsDir() {
+		warn(fmt.Sprintf("WAL archive %s recorded in the manifest is not here; point --wal-archive-dir at it", m.WALArchive))
+		return ""
+	}
+	return m.WALArchive
+}
+
+// archiveRestoreCommand returns a restore_command that copies WAL files out
+// of dir. The path is the one the server sees, so it has to be quoted for
+// the shell running the command.
+func archiveRestoreCommand(dir string) string {
+	return fmt.Sprintf("cp '%s/%%f' '%%p'", strings.ReplaceAll(dir, "'", `'\''`))
+}
+
+// quoteConfValue quotes a value for postgresql.conf syntax.
+func quoteConfValue(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
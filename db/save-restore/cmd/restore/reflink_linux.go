@@ -0,0 +1,22 @@
+//go:build linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// ficlone is the FICLONE ioctl, _IOW(0x94, 9, int) in the asm-generic
+// encoding of these architectures.
+const ficlone = 0x40049409
+
+// reflink makes dst share src's data blocks copy-on-write. It fails with
+// EOPNOTSUPP or EXDEV where the filesystem cannot do that.
+func reflink(dst, src *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !(linux && (386 || amd64 || arm || arm64 || loong64 || riscv64 || s390x))
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink is only implemented on Linux architectures with the asm-generic
+// ioctl encoding.
+func reflink(dst, src *os.File) error {
+	return errors.New("reflinks are not supported on this platform")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/report"
+	"github.com/timescaledb-tools/save-restore/internal/sentinel"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// checkReportPath refuses a --report path inside the data directory, which
+// the restore replaces.
+func checkReportPath(config *Config) error {
+	if config.Report == "" {
+		return nil
+	}
+	path, err := backupfs.Resolve(config.Report)
+	if err != nil {
+		return fmt.Errorf("failed to resolve --report %s: %w", config.Report, err)
+	}
+	if backupfs.Within(config.DataDir, path) {
+		return fmt.Errorf("--report %s is inside the data directory %s", config.Report, config.DataDir)
+	}
+	return nil
+}
+
+// describeSource fills in what the backup's manifest says about where it
+// came from, and whether its files were checked against the manifest.
+func describeSource(config *Config, backupInfo *BackupInfo, summary *restoreSummary) {
+	summary.VerifiedAfterWrite = config.VerifyAfterWrite && backupInfo.Format == "tar"
+
+	m, err := manifest.Read(config.BackupPath)
+	if err != nil {
+		summary.PGVersion = backupPGVersion(config, backupInfo, "")
+		return
+	}
+	// checkPrerequisites refuses a backup that does not match its manifest
+	summary.ManifestChecked = true
+	if m.Host != "" {
+		summary.Source = fmt.Sprintf("%s:%d", m.Host, m.Port)
+	}
+	created := m.CreatedAt
+	summary.BackupCreated = &created
+	summary.PGVersion = backupPGVersion(config, backupInfo, m.PGVersion)
+	for _, ext := range m.Extensions {
+		if ext.Name == "timescaledb" {
+			summary.TimescaleDB = ext.Version
+		}
+	}
+}
+
+// writeReport writes the --report page for the restore of source, whether
+// it succeeded or not; summary is nil when it failed before the end. A report
+// that cannot be written is reported but does not change the outcome.
+func writeReport(config *Config, source string, timeline *report.Timeline, summary *restoreSummary, runErr error) {
+	if config.Report == "" {
+		return
+	}
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would write report "+config.Report)
+		return
+	}
+	if runErr == nil {
+		runErr = ui.StrictError()
+	}
+
+	r := &report.Report{
+		Tool:       "restore",
+		Outcome:    sentinel.Success,
+		StartedAt:  timeline.Start,
+		FinishedAt: time.Now(),
+		Phases:     timeline.Phases(),
+	}
+	if runErr != nil {
+		r.Outcome = report.Failed
+		r.Error = runErr.Error()
+	}
+
+	if summary == nil {
+		r.Summary = []report.Field{
+			{Label: "Backup", Value: source},
+			{Label: "Data directory", Value: config.DataDir},
+		}
+	} else {
+		r.Summary = restoreReportFields(summary)
+		if summary.Source != "" {
+			r.Source = append(r.Source, report.Field{Label: "Server", Value: summary.Source})
+		}
+		if summary.BackupCreated != nil {
+			r.Source = append(r.Source, report.Field{Label: "Backup created", Value: summary.BackupCreated.Format("2006-01-02 15:04:05 MST")})
+		}
+		if summary.PGVersion != "" {
+			r.Source = append(r.Source, report.Field{Label: "PostgreSQL", Value: summary.PGVersion})
+		}
+		if summary.TimescaleDB != "" {
+			r.Source = append(r.Source, report.Field{Label: "TimescaleDB", Value: summary.TimescaleDB})
+		}
+	}
+
+	if err := report.Write(config.Report, r); err != nil {
+		warn(err.Error())
+		return
+	}
+	printMsg(colorGreen, "✓ Wrote report "+config.Report)
+}
+
+// restoreReportFields lists what the report shows about the restore.
+func restoreReportFields(s *restoreSummary) []report.Field {
+	fields := []report.Field{
+		{Label: "Backup", Value: s.Backup},
+		{Label: "Data directory", Value: s.DataDir},
+		{Label: "Restored size", Value: formatBytes(s.Size)},
+		{Label: "Files", Value: fmt.Sprintf("%d files in %d directories", s.Files, s.Directories)},
+	}
+	duration := time.Duration(s.Seconds * float64(time.Second))
+	fields = append(fields, report.Field{Label: "Restore time", Value: duration.String()})
+	if s.Seconds > 0 {
+		fields = append(fields, report.Field{Label: "Throughput", Value: formatBytes(int64(float64(s.Size)/s.Seconds)) + "/s"})
+	}
+	if s.RecoveryTarget != "" {
+		fields = append(fields, report.Field{Label: "Recovery target", Value: s.RecoveryTarget})
+	}
+
+	checked := "no manifest"
+	if s.ManifestChecked {
+		checked = "files match the manifest"
+	}
+	fields = append(fields, report.Field{Label: "Backup checked", Value: checked})
+	readBack := "no"
+	if s.VerifiedAfterWrite {
+		readBack = "yes, every extracted file was read back and compared"
+	}
+	return append(fields, report.Field{Label: "Read back after writing", Value: readBack})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/report"
+	"github.com/timescaledb-tools/save-restore/internal/sentinel"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// restoreSummary is what the --sentinel marker records about a restore. The
+// --report page is rendered from it too.
+type restoreSummary struct {
+	Backup             string         `json:"backup"`
+	DataDir            string         `json:"data_dir"`
+	Size               int64          `json:"size"`
+	Files              int            `json:"files"`
+	Directories        int            `json:"directories"`
+	RecoveryTarget     string         `json:"recovery_target,omitempty"`
+	ManifestChecked    bool           `json:"manifest_checked"`
+	VerifiedAfterWrite bool           `json:"verified_after_write,omitempty"`
+	Source             string         `json:"source,omitempty"`
+	BackupCreated      *time.Time     `json:"backup_created,omitempty"`
+	PGVersion          string         `json:"pg_version,omitempty"`
+	TimescaleDB        string         `json:"timescaledb_version,omitempty"`
+	Seconds            float64        `json:"duration_seconds"`
+	Phases             []report.Phase `json:"phases,omitempty"`
+}
+
+// clearSentinel removes the marker of an earlier run before anything else
+// happens. The marker must not be inside the data directory, which the
+// restore replaces.
+func clearSentinel(config *Config) error {
+	if config.Sentinel == "" {
+		return nil
+	}
+	path, err := backupfs.Resolve(config.Sentinel)
+	if err != nil {
+		return fmt.Errorf("failed to resolve --sentinel %s: %w", config.Sentinel, err)
+	}
+	if backupfs.Within(config.DataDir, path) {
+		return fmt.Errorf("--sentinel %s is inside the data directory %s", config.Sentinel, config.DataDir)
+	}
+	return sentinel.Clear(config.Sentinel)
+}
+
+// writeSentinel writes the --sentinel marker once the restore has
+// succeeded; with --strict, warnings so far fail the run instead. A marker
+// that cannot be written is reported but does not fail the restore.
+func writeSentinel(config *Config, summary *restoreSummary) error {
+	if config.Sentinel == "" {
+		return nil
+	}
+	if err := ui.StrictError(); err != nil {
+		return err
+	}
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would write sentinel "+config.Sentinel)
+		return nil
+	}
+	if err := sentinel.Write(config.Sentinel, "restore", sentinel.Success, summary); err != nil {
+		warn(err.Error())
+		return nil
+	}
+	printMsg(colorGreen, "✓ Wrote sentinel "+config.Sentinel)
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build unix && !aix
+
+package main
+
+import "syscall"
+
+// syncAll asks the kernel to write all dirty pages to disk.
+func syncAll() {
+	syscall.Sync()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// tablespaceMapFile lists the tablespaces of a tar-format backup as
+// "<oid> <location>" lines. pg_basebackup writes it into base.tar, and
+// recovery from backup_label recreates the pg_tblspc links from it.
+const tablespaceMapFile = "tablespace_map"
+
+// tablespaceTarget is where the archive of one tablespace is restored.
+type tablespaceTarget struct {
+	OID      string
+	Name     string
+	Archive  string
+	Location string
+
+	// VersionDir is the PG_<major>_<catversion> directory in the archive.
+	// Replace is set when Location already holds it and the data directory
+	// being replaced links to Location, so it may be removed.
+	VersionDir string
+	Replace    bool
+}
+
+// tablespaceOID returns the OID of a tablespace archive such as 16385.tar.gz,
+// and false for base.tar, pg_wal.tar and anything else.
+func tablespaceOID(tarName string) (string, bool) {
+	name := tarBaseName(tarName)
+	if name == "" {
+		return "", false
+	}
+	if _, err := strconv.ParseUint(name, 10, 32); err != nil {
+		return "", false
+	}
+	return name, true
+}
+
+// planTablespaces decides where each tablespace archive of a tar backup goes:
+// the location given with --tablespace-map, else the one recorded in the
+// manifest, else the one in the backup's tablespace_map. A location that
+// already holds the archive's version directory is only reused when the
+// current data directory links to it, so a restore never overwrites the
+// tablespace of another cluster on the same host.
+func planTablespaces(config *Config, backupInfo *BackupInfo) ([]*tablespaceTarget, error) {
+	var targets []*tablespaceTarget
+	for _, tarFile := range backupInfo.Files {
+		if oid, ok := tablespaceOID(filepath.Base(tarFile)); ok {
+			targets = append(targets, &tablespaceTarget{OID: oid, Archive: tarFile})
+		}
+	}
+	if len(targets) == 0 {
+		return nil, nil
+	}
+
+	known, err := backupTablespaces(config, backupInfo)
+	if err != nil {
+		return nil, err
+	}
+	mapping := parseTablespaceMap(config.TablespaceMap)
+	linked := linkedTablespaces(config.DataDir)
+
+	fmt.Println("\nTablespaces:")
+	for _, t := range targets {
+		ts := known[t.OID]
+		t.Name = ts.Name
+		t.Location = ts.Location
+		for _, key := range []string{t.OID, ts.Name, ts.Location} {
+			if location, ok := mapping[key]; ok && key != "" {
+				t.Location = location
+				break
+			}
+		}
+
+		if t.Location == "" {
+			return nil, fmt.Errorf("no location known for tablespace %s; give one with --tablespace-map %s=/path", t.OID, t.OID)
+		}
+		if !filepath.IsAbs(t.Location) {
+			return nil, fmt.Errorf("tablespace %s location %s is not absolute", t.OID, t.Location)
+		}
+		resolved, err := backupfs.Resolve(t.Location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve tablespace location %s: %w", t.Location, err)
+		}
+		if backupfs.Within(config.DataDir, resolved) {
+			return nil, fmt.Errorf("tablespace %s location %s is inside the data directory", t.OID, t.Location)
+		}
+
+		if t.VersionDir, err = archiveTopDir(t.Archive); err != nil {
+			return nil, err
+		}
+		if _, err := os.Lstat(filepath.Join(t.Location, t.VersionDir)); err == nil {
+			if !linked[resolved] {
+				return nil, fmt.Errorf("%s already contains %s, which %s does not link to; remove it or restore the tablespace elsewhere with --tablespace-map %s=/path",
+					t.Location, t.VersionDir, config.DataDir, t.OID)
+			}
+			t.Replace = true
+		}
+
+		label := t.OID
+		if t.Name != "" {
+			label = fmt.Sprintf("%s (%s)", t.Name, t.OID)
+		}
+		note := ""
+		if t.Replace {
+			note = fmt.Sprintf(", replacing %s", t.VersionDir)
+		}
+		fmt.Printf("  %s → %s%s\n", label, t.Location, note)
+	}
+	return targets, nil
+}
+
+// backupTablespaces returns the tablespaces of the backup by OID, from the
+// manifest or, for backups without one, from tablespace_map in base.tar.
+func backupTablespaces(config *Config, backupInfo *BackupInfo) (map[string]manifest.Tablespace, error) {
+	known := map[string]manifest.Tablespace{}
+	if m, err := manifest.Read(config.BackupPath); err == nil && len(m.Tablespaces) > 0 {
+		for _, ts := range m.Tablespaces {
+			known[strconv.FormatUint(uint64(ts.OID), 10)] = ts
+		}
+		return known, nil
+	}
+
+	for _, tarFile := range backupInfo.Files {
+		if tarBaseName(tarFile) != "base" {
+			continue
+		}
+		data, err := readTarMember(tarFile, tablespaceMapFile)
+		if err != nil {
+			return nil, err
+		}
+		for oid, location := range parseTablespaceMapFile(data) {
+			known[oid] = manifest.Tablespace{Location: location}
+		}
+	}
+	return known, nil
+}
+
+// parseTablespaceMap turns the --tablespace-map OLD=NEW values into a map.
+// OLD is a tablespace OID, name or original location. Validate checks the
+// values.
+func parseTablespaceMap(values []string) map[string]string {
+	mapping := map[string]string{}
+	for _, value := range values {
+		old, location, _ := strings.Cut(value, "=")
+		mapping[strings.TrimRight(old, "/")] = filepath.Clean(location)
+	}
+	return mapping
+}
+
+// validateTablespaceMap checks the --tablespace-map values.
+func validateTablespaceMap(values []string) error {
+	for _, value := range values {
+		old, location, found := strings.Cut(value, "=")
+		if !found || old == "" || location == "" {
+			return fmt.Errorf("invalid --tablespace-map %q: must be OLD=NEW", value)
+		}
+		if !filepath.IsAbs(location) {
+			return fmt.Errorf("invalid --tablespace-map %q: %s is not an absolute path", value, location)
+		}
+	}
+	return nil
+}
+
+// parseTablespaceMapFile parses the contents of a tablespace_map file.
+func parseTablespaceMapFile(data []byte) map[string]string {
+	locations := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if oid, location, found := strings.Cut(scanner.Text(), " "); found {
+			locations[oid] = location
+		}
+	}
+	return locations
+}
+
+// linkedTablespaces returns the resolved targets of the pg_tblspc links in
+// the current data directory.
+func linkedTablespaces(dataDir string) map[string]bool {
+	linked := map[string]bool{}
+	entries, _ := os.ReadDir(filepath.Join(dataDir, "pg_tblspc"))
+	for _, entry := range entries {
+		if target, err := filepath.EvalSymlinks(filepath.Join(dataDir, "pg_tblspc", entry.Name())); err == nil {
+			linked[target] = true
+		}
+	}
+	return linked
+}
+
+// archiveTopDir returns the first directory in a tablespace archive, the
+// PG_<major>_<catversion> directory the tablespace's files are in.
+func archiveTopDir(tarFile string) (string, error) {
+	tarReader, err := openTar(tarFile)
+	if err != nil {
+		return "", err
+	}
+	defer tarReader.Close()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("%s is empty", filepath.Base(tarFile))
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %w", filepath.Base(tarFile), err)
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if top, _, _ := strings.Cut(name, "/"); top != "" {
+			return top, nil
+		}
+	}
+}
+
+// readTarMember returns the contents of the top-level file name in tarFile,
+// or nil if there is none.
+func readTarMember(tarFile, name string) ([]byte, error) {
+	tarReader, err := openTar(tarFile)
+	if err != nil {
+		return nil, err
+	}
+	defer tarReader.Close()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(tarFile), err)
+		}
+		if strings.TrimPrefix(header.Name, "./") == name {
+			return io.ReadAll(tarReader)
+		}
+	}
+}
+
+// linkTablespaces points pg_tblspc/<oid> at each restored tablespace, in
+// place of the empty directory pg_basebackup puts there, and rewrites
+// tablespace_map with the new locations for recovery from backup_label.
+func linkTablespaces(config *Config, targets []*tablespaceTarget) error {
+	if len(targets) == 0 {
+		return nil
+	}
+
+	tblspc := filepath.Join(config.DataDir, "pg_tblspc")
+	if err := os.MkdirAll(tblspc, config.DataDirMode); err != nil {
+		return fmt.Errorf("failed to create pg_tblspc: %w", err)
+	}
+
+	locations := map[string]string{}
+	for _, t := range targets {
+		link := filepath.Join(tblspc, t.OID)
+		if err := os.RemoveAll(link); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", link, err)
+		}
+		if err := os.Symlink(t.Location, link); err != nil {
+			return fmt.Errorf("failed to link tablespace %s: %w", t.OID, err)
+		}
+		locations[t.OID] = t.Location
+	}
+
+	mapPath := filepath.Join(config.DataDir, tablespaceMapFile)
+	if data, err := os.ReadFile(mapPath); err == nil {
+		for oid, location := range parseTablespaceMapFile(data) {
+			if _, ok := locations[oid]; !ok {
+				locations[oid] = location
+			}
+		}
+		oids := make([]string, 0, len(locations))
+		for oid := range locations {
+			oids = append(oids, oid)
+		}
+		sort.Strings(oids)
+
+		var b strings.Builder
+		for _, oid := range oids {
+			fmt.Fprintf(&b, "%s %s\n", oid, locations[oid])
+		}
+		if err := os.WriteFile(mapPath, []byte(b.String()), 0600); err != nil {
+			return fmt.Errorf("failed to update %s: %w", tablespaceMapFile, err)
+		}
+	}
+
+	printMsg(colorGreen, fmt.Sprintf("✓ Linked %d tablespace(s) in pg_tblspc", len(targets)))
+	return nil
+}
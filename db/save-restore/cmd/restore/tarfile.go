@@ -0,0 +1,193 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+)
+
+// Compression formats of tar files.
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionLZ4  = "lz4"
+)
+
+// compressionMagic maps the leading bytes of a compressed file to its format.
+var compressionMagic = []struct {
+	magic       []byte
+	compression string
+}{
+	{[]byte{0x1f, 0x8b}, compressionGzip},
+	{[]byte{0x28, 0xb5, 0x2f, 0xfd}, compressionZstd},
+	{[]byte{0x04, 0x22, 0x4d, 0x18}, compressionLZ4},
+}
+
+// tarSource is an open, possibly compressed, tar archive.
+type tarSource struct {
+	*tar.Reader
+	closers []io.Closer
+}
+
+// openTar opens a tar file from a backup. A tar file split into volumes is
+// read from its parts in order. Since the file is on disk, the decompressor
+// is chosen from its first bytes, so renamed files and ones from other tools
+// work; the extension only decides when the bytes do not.
+func openTar(path string) (*tarSource, error) {
+	r, err := backupfs.OpenVolumes(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tar file: %w", err)
+	}
+	closeFiles := func() {
+		r.Close()
+	}
+
+	buffered := bufio.NewReaderSize(r, 1024)
+	head, err := buffered.Peek(512)
+	if err != nil && err != io.EOF {
+		closeFiles()
+		return nil, fmt.Errorf("failed to read %s: %w", filepath.Base(path), err)
+	}
+
+	byName := compressionFromName(path)
+	compression := detectCompression(head)
+	switch {
+	case compression == "":
+		compression = byName
+	case compression != byName:
+		printMsg(colorYellow, fmt.Sprintf("Note: %s is %s despite its name, reading it as such", filepath.Base(path), describeCompression(compression)))
+	}
+
+	src, err := newTarSource(buffered, compression)
+	if err != nil {
+		closeFiles()
+		return nil, err
+	}
+	src.closers = append(src.closers, r)
+	return src, nil
+}
+
+// isTarName reports whether name has one of the tar file extensions.
+func isTarName(name string) bool {
+	for _, suffix := range backupfs.TarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tarBaseName returns the name of a tar file without its directory and tar
+// extension: base for base.tar.gz, and for a tar file renamed to base.
+func tarBaseName(name string) string {
+	name = filepath.Base(name)
+	for _, suffix := range backupfs.TarSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
+// looksLikeTar reports whether the file at path starts with the magic bytes
+// of a compressed file or with a tar header. It is used for files without
+// any extension, where the name does not tell.
+func looksLikeTar(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	return detectCompression(head[:n]) != ""
+}
+
+// detectCompression identifies the compression of a file from its first
+// bytes (at least 512 of them for an uncompressed tar), or returns "" if
+// they do not tell.
+func detectCompression(head []byte) string {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	// An uncompressed tar has "ustar" in its first header
+	if len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar")) {
+		return compressionNone
+	}
+	return ""
+}
+
+// compressionFromName tells the compression of a tar file by its extension.
+func compressionFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return compressionGzip
+	case strings.HasSuffix(name, ".zst"):
+		return compressionZstd
+	case strings.HasSuffix(name, ".lz4"):
+		return compressionLZ4
+	}
+	return compressionNone
+}
+
+func describeCompression(compression string) string {
+	if compression == compressionNone {
+		return "uncompressed"
+	}
+	return compression + "-compressed"
+}
+
+// newTarSource wraps r in the decompressor for compression and a tar reader.
+// Streams that cannot be rewound, such as tar files inside an archive, are
+// opened this way with the compression taken from their name.
+func newTarSource(r io.Reader, compression string) (*tarSource, error) {
+	src := &tarSource{}
+
+	switch compression {
+	case compressionGzip:
+		gzReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		src.closers = append(src.closers, gzReader)
+		r = gzReader
+	case compressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		src.closers = append(src.closers, zr.IOReadCloser())
+		r = zr
+	case compressionLZ4:
+		r = lz4.NewReader(r)
+	}
+
+	src.Reader = tar.NewReader(r)
+	return src, nil
+}
+
+// Close releases the decompressor and the underlying file.
+func (t *tarSource) Close() error {
+	var firstErr error
+	for _, c := range t.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Validate checks the whole configuration before anything is run and reports
+// every problem it finds, not just the first. parseFlags calls it after the
+// flags are parsed; code filling in a Config itself should do the same.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	modes := 0
+	for _, set := range []bool{c.ListContents, c.ChownOnly, len(c.RestoreFiles) > 0, c.RestoreGlobals} {
+		if set {
+			modes++
+		}
+	}
+	if modes > 1 {
+		add("--list-contents, --chown-only, --restore-file and --restore-globals are mutually exclusive")
+	}
+	if modes > 0 && c.Sentinel != "" {
+		// The marker records a full restore; the other modes leave the
+		// data directory as it was or only change parts of it
+		add("--sentinel only applies to a full restore, not to --list-contents, --chown-only, --restore-file or --restore-globals")
+	}
+	if len(c.RestoreFiles) > 0 {
+		if target, _ := recoveryTarget(c); target != "" {
+			add("--restore-file cannot be combined with a recovery target")
+		}
+		if err := validateRestoreFiles(c.RestoreFiles); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.RestoreGlobals {
+		if target, _ := recoveryTarget(c); target != "" {
+			add("--restore-globals cannot be combined with a recovery target")
+		}
+	} else if c.Host != "" || c.Port != 0 || c.User != "" {
+		add("--host, --port and --user only apply to --restore-globals")
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		add("invalid --port %d", c.Port)
+	}
+
+	if c.BackupPath == "" {
+		if !c.ChownOnly {
+			add("--backup is required")
+		}
+	} else if _, err := os.Stat(c.BackupPath); err != nil {
+		add("backup %s not found", c.BackupPath)
+	}
+
+	if c.DataDir == "" && !c.ListContents {
+		add("--data-dir must not be empty")
+	}
+	// PostgreSQL only starts with a data directory mode of 0700, or 0750
+	// when the cluster was initialized with group access
+	if c.DataDirMode != 0 && c.DataDirMode != 0700 && c.DataDirMode != 0750 {
+		add("invalid --data-dir-mode %04o: PostgreSQL requires 0700 or 0750", c.DataDirMode)
+	}
+
+	if c.StagingDir != "" {
+		if info, err := os.Stat(c.StagingDir); err != nil || !info.IsDir() {
+			add("--staging-dir %s is not a directory", c.StagingDir)
+		}
+	}
+	if c.ExtensionDir != "" {
+		if info, err := os.Stat(c.ExtensionDir); err != nil || !info.IsDir() {
+			add("--extension-dir %s is not a directory", c.ExtensionDir)
+		}
+	}
+
+	switch c.CopyMethod {
+	case copyMethodCopy, copyMethodReflink, copyMethodHardlink:
+	default:
+		add("invalid --copy-method %q: must be copy, reflink or hardlink", c.CopyMethod)
+	}
+	if c.CopyMethod == copyMethodHardlink && !c.HardlinkConsumesBackup {
+		add("--copy-method hardlink shares the backup's files with the data directory, where the cluster, chown and chmod change them; add --hardlink-consumes-backup if the backup is not needed again")
+	}
+	if c.ExtractWorkers < 1 {
+		add("--extract-workers must be at least 1")
+	}
+	if c.Output != "text" && c.Output != "json" {
+		add("--output must be text or json")
+	}
+	if n := c.WALSegmentSizeMB; n != 0 && (n < 1 || n > 1024 || n&(n-1) != 0) {
+		add("invalid --wal-segment-size %d: must be a power of two between 1 and 1024 MB", n)
+	}
+	if c.UID < 0 || c.GID < 0 {
+		add("--uid and --gid must not be negative")
+	}
+
+	if c.TargetPGVersion != "" && !versionPattern.MatchString(c.TargetPGVersion) {
+		add("invalid --target-pg-version %q: must be a major version such as 16", c.TargetPGVersion)
+	}
+	if c.TargetTimescaleVersion != "" && !versionPattern.MatchString(c.TargetTimescaleVersion) {
+		add("invalid --target-timescale-version %q: must be a version such as 2.14.2", c.TargetTimescaleVersion)
+	}
+
+	if c.WALArchiveDir != "" {
+		if target, _ := recoveryTarget(c); target == "" {
+			add("--wal-archive-dir needs a recovery target")
+		} else if !filepath.IsAbs(c.WALArchiveDir) {
+			add("--wal-archive-dir %s must be an absolute path", c.WALArchiveDir)
+		}
+	}
+	if c.RestoreCommand != "" {
+		if target, _ := recoveryTarget(c); target == "" {
+			add("--restore-command needs a recovery target")
+		} else if !strings.Contains(c.RestoreCommand, "%p") {
+			add("--restore-command %q has no %%p; the server would not get the WAL file it asks for", c.RestoreCommand)
+		}
+		if c.WALArchiveDir != "" {
+			add("--restore-command and --wal-archive-dir are mutually exclusive")
+		}
+	}
+	if err := validateTablespaceMap(c.TablespaceMap); err != nil {
+		errs = append(errs, err)
+	}
+
+	if err := validateRecoveryTarget(c); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
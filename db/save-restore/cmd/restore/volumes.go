@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// findTarFiles returns the tar files in dir ending in suffix, including tar
+// files split into volumes by save --split-size, which are reported under
+// their unsplit name.
+func findTarFiles(dir, suffix string) []string {
+	tarFiles, _ := filepath.Glob(filepath.Join(dir, "*"+suffix))
+
+	firstParts, _ := filepath.Glob(filepath.Join(dir, manifest.VolumeName("*"+suffix, 1)))
+	for _, part := range firstParts {
+		tarFiles = append(tarFiles, strings.TrimSuffix(part, filepath.Ext(part)))
+	}
+
+	sort.Strings(tarFiles)
+	return tarFiles
+}
+
+// findBackupTars returns the tar files of the backup in dir under any of
+// backupfs.TarSuffixes, and files without an extension whose first bytes
+// show a renamed tar file. When two files share a base name, such as
+// base.tar and base.tar.gz, the one with the earlier suffix is used; the
+// decompressor is chosen by openTar in either case.
+func findBackupTars(dir string) []string {
+	seen := map[string]bool{}
+	var tarFiles []string
+	for _, suffix := range backupfs.TarSuffixes {
+		for _, tarFile := range findTarFiles(dir, suffix) {
+			if name := tarBaseName(tarFile); !seen[name] {
+				seen[name] = true
+				tarFiles = append(tarFiles, tarFile)
+			}
+		}
+	}
+
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || filepath.Ext(name) != "" || seen[name] {
+			continue
+		}
+		if path := filepath.Join(dir, name); looksLikeTar(path) {
+			seen[name] = true
+			tarFiles = append(tarFiles, path)
+		}
+	}
+
+	sort.Strings(tarFiles)
+	return tarFiles
+}
+
+// checkVolumes makes sure every split tar file in the backup is complete
+// before anything is extracted: the manifest's part count and size must
+// match, and there must be no gap in the numbering.
+func checkVolumes(config *Config, tarFiles []string) error {
+	expected := map[string]manifest.Volume{}
+	if m, err := manifest.Read(config.BackupPath); err == nil {
+		for _, v := range m.Volumes {
+			expected[v.Name] = v
+		}
+	}
+
+	for name, v := range expected {
+		if _, err := os.Stat(filepath.Join(config.BackupPath, manifest.VolumeName(name, 1))); err != nil {
+			return fmt.Errorf("%s is split into %d volumes but %s is missing", name, v.Parts, manifest.VolumeName(name, 1))
+		}
+	}
+
+	for _, tarFile := range tarFiles {
+		parts := backupfs.VolumeParts(tarFile)
+		if len(parts) == 1 && parts[0] == tarFile {
+			continue
+		}
+		name := filepath.Base(tarFile)
+
+		// Any volume numbered past the contiguous run means one is missing
+		all, _ := filepath.Glob(tarFile + ".[0-9][0-9][0-9]")
+		for _, part := range all {
+			n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Ext(part), "."))
+			if n > len(parts) {
+				return fmt.Errorf("volume %s of %s is missing", manifest.VolumeName(name, len(parts)+1), name)
+			}
+		}
+
+		v, ok := expected[name]
+		if !ok {
+			warn(fmt.Sprintf("%s has %d volumes but no manifest entry; cannot check that none are missing at the end", name, len(parts)))
+			continue
+		}
+		if len(parts) != v.Parts {
+			return fmt.Errorf("%s should have %d volumes but only %d are present", name, v.Parts, len(parts))
+		}
+
+		var size int64
+		for _, part := range parts {
+			info, err := os.Stat(part)
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		if size != v.Size {
+			return fmt.Errorf("volumes of %s add up to %d bytes, expected %d", name, size, v.Size)
+		}
+		printMsg(colorGreen, fmt.Sprintf("✓ All %d volumes of %s present", len(parts), name))
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// checkWALSegmentSize compares the WAL segment size recorded in the backup's
+// manifest with the one given as --wal-segment-size, what the target's
+// tooling and configuration are set up for, and refuses to go on when they
+// differ. Without --wal-segment-size the check is skipped: the backup brings
+// its own pg_control, so a different size in the cluster about to be
+// replaced only gets a notice.
+func checkWALSegmentSize(config *Config) error {
+	m, err := manifest.Read(config.BackupPath)
+	if err != nil || m.WALSegmentSize == 0 {
+		return nil
+	}
+
+	if config.WALSegmentSizeMB == 0 {
+		noteReplacedWALSegmentSize(config, m.WALSegmentSize)
+		return nil
+	}
+
+	target := int64(config.WALSegmentSizeMB) * 1024 * 1024
+	if target != m.WALSegmentSize {
+		return fmt.Errorf("backup has a WAL segment size of %s but --wal-segment-size expects %s; the restored cluster would not match",
+			formatBytes(m.WALSegmentSize), formatBytes(target))
+	}
+
+	printMsg(colorGreen, fmt.Sprintf("✓ WAL segment size %s matches the target", formatBytes(target)))
+	return nil
+}
+
+// noteReplacedWALSegmentSize tells when the cluster currently in the data
+// directory uses another WAL segment size than the backup, which the
+// restored cluster takes over.
+func noteReplacedWALSegmentSize(config *Config, size int64) {
+	if _, err := os.Stat(filepath.Join(config.DataDir, "global", "pg_control")); err != nil {
+		return
+	}
+	control, err := readControlData(config.DataDir)
+	if err != nil {
+		return
+	}
+	existing, err := strconv.ParseInt(control["Bytes per WAL segment"], 10, 64)
+	if err != nil || existing == size {
+		return
+	}
+	printMsg(colorBlue, fmt.Sprintf("The cluster being replaced uses %s WAL segments, the restored one will use the backup's %s",
+		formatBytes(existing), formatBytes(size)))
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+)
+
+// createArchive packs a finished tar-format backup directory, including its
+// manifest and checksums, into finalPath.tar.zst and removes the directory.
+// Every member is stored under "<backup name>/", the base name of finalPath,
+// so the archive unpacks to the layout the directory would have had.
+func createArchive(config *Config, backupPath, finalPath string) (string, error) {
+	archivePath := finalPath + backupfs.ArchiveSuffix
+
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would package backup into "+archivePath)
+		return archivePath, nil
+	}
+
+	printMsg(colorBlue, "\nPackaging backup into "+archivePath)
+
+	// Written under a temporary name like the backup directory itself
+	tmpArchive := tempPath(archivePath)
+	out, err := os.Create(tmpArchive)
+	if err != nil {
+		return "", fmt.Errorf("failed to create archive: %w", err)
+	}
+	defer out.Close()
+
+	zw, err := newArchiveWriter(config, out)
+	if err != nil {
+		return "", fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+
+	tw := tar.NewWriter(zw)
+	if err := addDirToTar(tw, backupPath, filepath.Base(finalPath), nil); err != nil {
+		zw.Close()
+		return "", err
+	}
+
+	if err := tw.Close(); err != nil {
+		zw.Close()
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpArchive, archivePath); err != nil {
+		return "", fmt.Errorf("failed to move archive into place: %w", err)
+	}
+
+	if err := os.RemoveAll(backupPath); err != nil {
+		return "", fmt.Errorf("failed to remove packaged backup directory: %w", err)
+	}
+
+	info, err := os.Stat(archivePath)
+	if err != nil {
+		return "", err
+	}
+	printMsg(colorGreen, fmt.Sprintf("✓ Archive created, size: %s", formatBytes(info.Size())))
+
+	return archivePath, nil
+}
+
+// addDirToTar writes srcDir into tw with every member name under prefix,
+// keeping modes and symlinks. With an empty prefix the directory itself is not
+// stored and members are named relative to it, like pg_basebackup does. Paths
+// for which skip returns true are left out, directories with their contents.
+func addDirToTar(tw *tar.Writer, srcDir, prefix string, skip func(rel string) bool) error {
+	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if prefix == "" && rel == "." {
+			return nil
+		}
+		if skip != nil && skip(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := filepath.ToSlash(filepath.Join(prefix, rel))
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return fmt.Errorf("failed to write tar header for %s: %w", name, err)
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if _, err := io.Copy(tw, f); err != nil {
+			return fmt.Errorf("failed to add %s: %w", name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// benchmarkCycle holds the measurements of one backup/restore round trip.
+// Durations are in seconds, throughputs in bytes per second.
+type benchmarkCycle struct {
+	Cycle             int     `json:"cycle"`
+	BackupSeconds     float64 `json:"backup_seconds"`
+	BackupSize        int64   `json:"backup_size"`
+	BackupThroughput  float64 `json:"backup_throughput"`
+	RestoreSeconds    float64 `json:"restore_seconds"`
+	RestoredSize      int64   `json:"restored_size"`
+	RestoreThroughput float64 `json:"restore_throughput"`
+	StartSeconds      float64 `json:"start_seconds"`
+	VerifySeconds     float64 `json:"verify_seconds"`
+	TotalSeconds      float64 `json:"total_seconds"`
+}
+
+// benchmarkStats summarizes one measurement over all cycles.
+type benchmarkStats struct {
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+	P95  float64 `json:"p95"`
+}
+
+// benchmarkReport is what `save benchmark --output json` prints.
+type benchmarkReport struct {
+	Host    string                    `json:"host"`
+	Port    int                       `json:"port"`
+	Format  string                    `json:"format"`
+	Cycles  []benchmarkCycle          `json:"cycles"`
+	Summary map[string]benchmarkStats `json:"summary"`
+}
+
+// runBenchmark implements `save benchmark`, which times repeated
+// backup → restore → start → SELECT 1 round trips against a throwaway
+// cluster. Backups go to a scratch directory next to the test restores and
+// are removed after each cycle.
+func runBenchmark(args []string) error {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	config := &Config{}
+	fs.StringVar(&config.Host, "host", getEnv("PGHOST", "localhost"), "PostgreSQL host")
+	fs.IntVar(&config.Port, "port", getEnvInt("PGPORT", 5432), "PostgreSQL port")
+	fs.StringVar(&config.User, "user", getEnv("PGUSER", "postgres"), "PostgreSQL user")
+	fs.StringVar(&config.Password, "password", getEnv("PGPASSWORD", ""), "PostgreSQL password, or a vault:// or awssm:// secret reference")
+	fs.StringVar(&config.Database, "database", getEnv("PGDATABASE", "postgres"), "PostgreSQL database")
+	addServiceFlag(fs, config)
+	fs.StringVar(&config.Format, "format", "tar", "Backup format (tar or plain)")
+	fs.IntVar(&config.Compress, "compress", 6, "Compression level (0-9)")
+	fs.StringVar(&config.Checkpoint, "checkpoint", "fast", "Checkpoint mode (fast or spread)")
+	addCompressFlags(fs, config)
+	cycles := fs.Int("cycles", 3, "Number of backup/restore round trips")
+	output := fs.String("output", "text", "Output format (text or json)")
+	addTestRestoreFlags(fs, &config.TestRestore)
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: save benchmark [options]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *cycles < 1 {
+		return fmt.Errorf("--cycles must be at least 1")
+	}
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("--output must be text or json")
+	}
+
+	if err := applyService(fs, config); err != nil {
+		return err
+	}
+	config.NoProgress = true
+	config.OnFailure = "cleanup"
+	config.ArchiveLevel = defaultArchiveLevel
+	config.BackupDir = os.TempDir()
+	if config.TestRestore.ScratchDir != "" {
+		config.BackupDir = config.TestRestore.ScratchDir
+	}
+	config.TestRestore.User = config.User
+	if err := config.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	password, err := resolveSecret(config.Password)
+	if err != nil {
+		return err
+	}
+	if password != "" {
+		os.Setenv("PGPASSWORD", password)
+	}
+	config.Password = password
+
+	// Progress goes to stderr so stdout only carries the JSON report
+	if *output == "json" {
+		ui.SetOutput(os.Stderr)
+	}
+
+	printMsg(colorGreen, "PostgreSQL Backup Benchmark")
+	fmt.Fprintln(ui.Output(), strings.Repeat("=", 50))
+
+	if _, err := testConnection(config); err != nil {
+		return fmt.Errorf("connection test failed: %w", err)
+	}
+
+	scratch, err := os.MkdirTemp(config.BackupDir, "benchmark-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer func() {
+		if config.TestRestore.KeepScratch {
+			printMsg(colorYellow, "Keeping scratch directory "+scratch)
+			return
+		}
+		os.RemoveAll(scratch)
+	}()
+
+	report := &benchmarkReport{Host: config.Host, Port: config.Port, Format: config.Format}
+	for n := 1; n <= *cycles; n++ {
+		printMsg(colorBold, fmt.Sprintf("\nCycle %d/%d", n, *cycles))
+		cycle, err := benchmarkOnce(config, scratch, n)
+		if err != nil {
+			return fmt.Errorf("cycle %d failed: %w", n, err)
+		}
+		report.Cycles = append(report.Cycles, *cycle)
+	}
+	report.Summary = summarizeCycles(report.Cycles)
+
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printBenchmark(report)
+	return nil
+}
+
+// benchmarkOnce runs one round trip: a backup into the scratch directory and
+// a test restore of it.
+func benchmarkOnce(config *Config, scratch string, n int) (*benchmarkCycle, error) {
+	cycleConfig := *config
+	cycleConfig.OutputDir = filepath.Join(scratch, fmt.Sprintf("backup-%d", n))
+
+	start := time.Now()
+	result, err := createBackup(&cycleConfig, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("backup failed: %w", err)
+	}
+	backupTime := time.Since(start)
+	defer os.RemoveAll(result.Path)
+
+	backupSize, _, err := dirSize(result.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	timings, err := timedTestRestore(result.Path, &cycleConfig.TestRestore)
+	if err != nil {
+		return nil, fmt.Errorf("restore failed: %w", err)
+	}
+
+	return &benchmarkCycle{
+		Cycle:             n,
+		BackupSeconds:     backupTime.Seconds(),
+		BackupSize:        backupSize,
+		BackupThroughput:  throughput(backupSize, backupTime),
+		RestoreSeconds:    timings.Restore.Seconds(),
+		RestoredSize:      timings.RestoredSize,
+		RestoreThroughput: throughput(timings.RestoredSize, timings.Restore),
+		StartSeconds:      timings.Start.Seconds(),
+		VerifySeconds:     timings.Verify.Seconds(),
+		TotalSeconds:      time.Since(start).Seconds(),
+	}, nil
+}
+
+func throughput(size int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(size) / d.Seconds()
+}
+
+// summarizeCycles computes the statistics of every measurement.
+func summarizeCycles(cycles []benchmarkCycle) map[string]benchmarkStats {
+	measures := map[string]func(c benchmarkCycle) float64{
+		"backup_seconds":     func(c benchmarkCycle) float64 { return c.BackupSeconds },
+		"backup_throughput":  func(c benchmarkCycle) float64 { return c.BackupThroughput },
+		"restore_seconds":    func(c benchmarkCycle) float64 { return c.RestoreSeconds },
+		"restore_throughput": func(c benchmarkCycle) float64 { return c.RestoreThroughput },
+		"start_seconds":      func(c benchmarkCycle) float64 { return c.StartSeconds },
+		"verify_seconds":     func(c benchmarkCycle) float64 { return c.VerifySeconds },
+		"total_seconds":      func(c benchmarkCycle) float64 { return c.TotalSeconds },
+	}
+
+	summary := map[string]benchmarkStats{}
+	for name, measure := range measures {
+		values := make([]float64, len(cycles))
+		for i, c := range cycles {
+			values[i] = measure(c)
+		}
+		summary[name] = computeStats(values)
+	}
+	return summary
+}
+
+// computeStats returns min, max, mean and the nearest-rank 95th percentile.
+func computeStats(values []float64) benchmarkStats {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	rank := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+	return benchmarkStats{
+		Min:  sorted[0],
+		Max:  sorted[len(sorted)-1],
+		Mean: sum / float64(len(sorted)),
+		P95:  sorted[max(rank, 0)],
+	}
+}
+
+func printBenchmark(report *benchmarkReport) {
+	fmt.Println("\n" + ui.Colorize(colorBold, "Cycles:"))
+	fmt.Printf("%-6s %10s %10s %12s %10s %12s %9s %9s\n",
+		"CYCLE", "BACKUP", "SIZE", "BACKUP/S", "RESTORE", "RESTORE/S", "START", "VERIFY")
+	for _, c := range report.Cycles {
+		fmt.Printf("%-6d %9.1fs %10s %12s %9.1fs %12s %8.1fs %8.3fs\n",
+			c.Cycle, c.BackupSeconds, formatBytes(c.BackupSize), formatBytes(int64(c.BackupThroughput)),
+			c.RestoreSeconds, formatBytes(int64(c.RestoreThroughput)), c.StartSeconds, c.VerifySeconds)
+	}
+
+	fmt.Println("\n" + ui.Colorize(colorBold, "Summary:"))
+	fmt.Printf("%-18s %12s %12s %12s %12s\n", "", "MIN", "MAX", "MEAN", "P95")
+	for _, row := range []struct {
+		name  string
+		bytes bool
+	}{
+		{"backup_seconds", false}, {"backup_throughput", true},
+		{"restore_seconds", false}, {"restore_throughput", true},
+		{"start_seconds", false}, {"verify_seconds", false}, {"total_seconds", false},
+	} {
+		s := report.Summary[row.name]
+		format := func(v float64) string {
+			if row.bytes {
+				return formatBytes(int64(v)) + "/s"
+			}
+			return fmt.Sprintf("%.3fs", v)
+		}
+		fmt.Printf("%-18s %12s %12s %12s %12s\n", row.name, format(s.Min), format(s.Max), format(s.Mean), format(s.P95))
+	}
+}
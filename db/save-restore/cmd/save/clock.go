@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// checkClock reads the server's clock and compares it with the local one.
+// Backups are named after the local time while backup_label, and with it
+// recovery targets, use the server's, so a skew beyond --max-clock-skew is
+// warned about (an error with --strict). The local time is taken halfway
+// through the query to leave out the round trip.
+func checkClock(config *Config, db *sql.DB) (*manifest.Clock, error) {
+	before := time.Now()
+	var server time.Time
+	if err := db.QueryRow("SELECT clock_timestamp()").Scan(&server); err != nil {
+		return nil, fmt.Errorf("failed to read the server's clock: %w", err)
+	}
+	after := time.Now()
+	clock := &manifest.Clock{
+		Local:  before.Add(after.Sub(before) / 2).UTC().Round(time.Millisecond),
+		Server: server.UTC().Round(time.Millisecond),
+	}
+
+	skew := clock.Skew()
+	if config.MaxClockSkew > 0 && skew.Abs() > config.MaxClockSkew {
+		direction := "ahead of"
+		if skew < 0 {
+			direction = "behind"
+		}
+		warn(fmt.Sprintf("The server's clock is %s %s this host's (more than --max-clock-skew %s); "+
+			"backup names and backup_label times will disagree, check NTP on both", skew.Abs(), direction, config.MaxClockSkew))
+	} else {
+		printMsg(colorGreen, fmt.Sprintf("✓ Server clock is within %s of this host's", skew.Abs().Round(time.Millisecond)))
+	}
+	return clock, nil
+}
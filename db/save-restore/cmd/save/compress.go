@@ -0,0 +1,84 @@
+package main
+
+import (
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"runtime"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
+)
+
+// Implementations of the gzip compression save does itself, when it
+// rewrites tar files for --exclude and in `save convert`. pg_basebackup -z
+// compresses the base backup on its own and is not affected.
+const (
+	compressImplStandard = "standard" // compress/gzip, one core
+	compressImplParallel = "parallel" // pgzip, one block per worker
+)
+
+// parallelBlockSize is the block each pgzip worker compresses. A worker
+// holds about two blocks, which is what --compress-workers trades for speed.
+const parallelBlockSize = 1 << 20
+
+// defaultArchiveLevel is the zstd level of --archive-tar, zstd's own default.
+const defaultArchiveLevel = 3
+
+// addCompressFlags registers the options of save's own compression on fs.
+func addCompressFlags(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.CompressImpl, "compress-impl", compressImplStandard, "gzip implementation for tar files save compresses itself: standard, or parallel for multi-core throughput")
+	fs.IntVar(&config.CompressWorkers, "compress-workers", 0, "Cores for parallel gzip and the zstd archive, each holding about 2 MiB (default: all)")
+}
+
+// validateCompressFlags checks the options added by addCompressFlags.
+func validateCompressFlags(config *Config) error {
+	if config.CompressImpl != compressImplStandard && config.CompressImpl != compressImplParallel {
+		return fmt.Errorf("--compress-impl must be %s or %s", compressImplStandard, compressImplParallel)
+	}
+	if config.CompressWorkers < 0 {
+		return fmt.Errorf("--compress-workers must not be negative")
+	}
+	return nil
+}
+
+// compressWorkers is the number of goroutines compressing at once.
+func compressWorkers(config *Config) int {
+	if config.CompressWorkers > 0 {
+		return config.CompressWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// newGzipWriter returns a writer compressing to w at --compress with the
+// --compress-impl implementation. Both write ordinary gzip.
+func newGzipWriter(config *Config, w io.Writer) (io.WriteCloser, error) {
+	if config.CompressImpl != compressImplParallel {
+		zw, err := gzip.NewWriterLevel(w, config.Compress)
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	}
+	zw, err := pgzip.NewWriterLevel(w, config.Compress)
+	if err != nil {
+		return nil, err
+	}
+	if err := zw.SetConcurrency(parallelBlockSize, compressWorkers(config)); err != nil {
+		return nil, err
+	}
+	return zw, nil
+}
+
+// newArchiveWriter returns the zstd writer of --archive-tar at
+// --archive-level.
+func newArchiveWriter(config *Config, w io.Writer) (*zstd.Encoder, error) {
+	level := config.ArchiveLevel
+	if level == 0 {
+		level = defaultArchiveLevel
+	}
+	return zstd.NewWriter(w,
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(compressWorkers(config)))
+}
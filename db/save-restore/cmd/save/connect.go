@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// pingTimeout bounds each connection attempt.
+const pingTimeout = 5 * time.Second
+
+// pingWithRetry opens the connection to the server, retrying up to
+// --connect-retries times when the attempt fails at the connection level. A
+// failover briefly leaves the primary endpoint unreachable or starting up;
+// errors like a wrong password are reported at once.
+func pingWithRetry(config *Config, db *sql.DB) error {
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+		if attempt >= config.ConnectRetries || !isConnectionError(err) {
+			return err
+		}
+
+		printMsg(colorYellow, fmt.Sprintf("Connection attempt %d/%d failed: %v; retrying in %s",
+			attempt+1, config.ConnectRetries+1, err, config.ConnectRetryDelay))
+		time.Sleep(config.ConnectRetryDelay)
+	}
+}
+
+// isConnectionError reports whether err means the server could not be
+// reached or is not accepting connections yet, as opposed to the server
+// rejecting this client.
+func isConnectionError(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// 57P03 cannot_connect_now: starting up, shutting down or in recovery;
+		// class 08: connection exceptions
+		return pqErr.Code == "57P03" || pqErr.Code.Class() == "08"
+	}
+
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr), errors.As(err, &netErr):
+		return true
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.ECONNRESET):
+		return true
+	}
+	return false
+}
+
+// describeConnectError turns a failed connection attempt into an error that
+// says whether the credentials or the network are at fault, so operators do
+// not chase connectivity for a wrong password.
+func describeConnectError(config *Config, err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "28P01": // invalid_password
+			return fmt.Errorf("authentication failed for user %s: wrong password (check --password or PGPASSWORD): %w",
+				config.User, err)
+		case "28000": // invalid_authorization_specification
+			return fmt.Errorf("authentication failed for user %s: not allowed by the server (check pg_hba.conf and that the role exists): %w",
+				config.User, err)
+		}
+	}
+	if isConnectionError(err) {
+		return fmt.Errorf("could not reach host %s:%d: %w", config.Host, config.Port, err)
+	}
+	return err
+}
+
+// baseBackupFailures map libpq messages in pg_basebackup's stderr to what
+// they mean, checked in order.
+var baseBackupFailures = []struct {
+	pattern string
+	reason  string
+}{
+	{"password authentication failed", "authentication failed for user %s: wrong password (check --password or PGPASSWORD)"},
+	{"no password supplied", "authentication failed for user %s: the server requires a password and none was given"},
+	{"no pg_hba.conf entry for replication connection", "authentication failed for user %s: pg_hba.conf has no replication entry for this host and user"},
+	{"no pg_hba.conf entry", "authentication failed for user %s: pg_hba.conf does not allow this host and user"},
+	{"Connection refused", "could not reach host %s:%d: connection refused"},
+	{"could not translate host name", "could not reach host %s:%d: unknown host name"},
+	{"No route to host", "could not reach host %s:%d: no route to host"},
+	{"Network is unreachable", "could not reach host %s:%d: network is unreachable"},
+	{"timeout expired", "could not reach host %s:%d: connection timed out"},
+	{"canceling statement due to lock timeout", "a lock on %s:%d was not granted within --lock-timeout"},
+}
+
+// describeBaseBackupFailure explains a pg_basebackup failure from its
+// output, or returns "" if the output does not point at the credentials or
+// the network.
+func describeBaseBackupFailure(config *Config, output string) string {
+	for _, failure := range baseBackupFailures {
+		if !strings.Contains(output, failure.pattern) {
+			continue
+		}
+		if strings.HasPrefix(failure.reason, "authentication") {
+			return fmt.Sprintf(failure.reason, config.User)
+		}
+		return fmt.Sprintf(failure.reason, config.Host, config.Port)
+	}
+	return ""
+}
+
+// baseBackupError builds the error for a failed pg_basebackup run.
+func baseBackupError(config *Config, err error, output string) error {
+	if reason := describeBaseBackupFailure(config, output); reason != "" {
+		return fmt.Errorf("pg_basebackup failed: %s: %w\nOutput: %s", reason, err, output)
+	}
+	return fmt.Errorf("pg_basebackup failed: %w\nOutput: %s", err, output)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/backuplabel"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// runConvert implements `save convert`, which repackages an existing backup
+// between the plain and tar formats without running pg_basebackup again. The
+// direction is taken from the source: a plain backup becomes base.tar[.gz]
+// plus pg_wal.tar[.gz], a tar backup is unpacked into a plain directory.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	compress := fs.Int("compress", 6, "Compression level for tar output (0-9, 0 writes uncompressed .tar)")
+	tablespaceDir := fs.String("tablespace-dir", "", "Directory to unpack the tablespace archives (<oid>.tar) of a tar backup into, one <oid> directory each; required for tar backups with tablespaces")
+	config := &Config{}
+	addCompressFlags(fs, config)
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: save convert [--compress N] [--compress-impl parallel] [--tablespace-dir DIR] <source-backup> <destination>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return fmt.Errorf("convert needs a source backup and a destination")
+	}
+	if *compress < 0 || *compress > 9 {
+		return fmt.Errorf("compression level must be between 0 and 9")
+	}
+	if err := validateCompressFlags(config); err != nil {
+		return err
+	}
+	config.Compress = *compress
+
+	src, dst := fs.Arg(0), fs.Arg(1)
+
+	printMsg(colorGreen, "PostgreSQL Backup Conversion")
+	fmt.Println(strings.Repeat("=", 50))
+
+	entries, err := os.ReadDir(dst)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check destination: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("destination %s already exists and is not empty", dst)
+	}
+	if *tablespaceDir != "" {
+		if *tablespaceDir, err = filepath.Abs(*tablespaceDir); err != nil {
+			return fmt.Errorf("failed to resolve --tablespace-dir: %w", err)
+		}
+		absDst, _ := filepath.Abs(dst)
+		if backupfs.Within(absDst, *tablespaceDir) {
+			return fmt.Errorf("--tablespace-dir %s must be outside the destination %s", *tablespaceDir, dst)
+		}
+		entries, err := os.ReadDir(*tablespaceDir)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to check --tablespace-dir: %w", err)
+		}
+		if len(entries) > 0 {
+			return fmt.Errorf("--tablespace-dir %s already exists and is not empty", *tablespaceDir)
+		}
+	}
+
+	switch {
+	case fileExists(filepath.Join(src, "PG_VERSION")):
+		config.Format = "tar"
+		printMsg(colorBlue, fmt.Sprintf("Converting plain backup %s to tar format in %s", src, dst))
+	case findTar(src, "base") != "":
+		config.Format = "plain"
+		printMsg(colorBlue, fmt.Sprintf("Converting tar backup %s to plain format in %s", src, dst))
+	default:
+		return fmt.Errorf("no plain or tar backup found in %s", src)
+	}
+	if *tablespaceDir != "" && config.Format != "plain" {
+		return fmt.Errorf("--tablespace-dir only applies to converting tar backups")
+	}
+
+	// Nothing of a failed conversion is kept, so it can simply be re-run
+	cleanup := func() {
+		os.RemoveAll(dst)
+		if *tablespaceDir != "" {
+			for oid := range tablespaceArchives(src) {
+				os.RemoveAll(filepath.Join(*tablespaceDir, oid))
+			}
+		}
+	}
+
+	// Plain backups are data directories and need PostgreSQL's mode
+	dirMode := os.FileMode(0755)
+	if config.Format == "plain" {
+		dirMode = 0700
+	}
+	if err := os.MkdirAll(dst, dirMode); err != nil {
+		return fmt.Errorf("failed to create destination: %w", err)
+	}
+
+	if config.Format == "tar" {
+		err = plainToTar(config, src, dst)
+	} else {
+		err = tarToPlain(src, dst, *tablespaceDir)
+	}
+	if err != nil {
+		cleanup()
+		return fmt.Errorf("conversion failed: %w", err)
+	}
+
+	if err := verifyBackup(config, dst); err != nil {
+		cleanup()
+		return fmt.Errorf("converted backup failed verification: %w", err)
+	}
+
+	if err := writeConvertedManifest(config, src, dst); err != nil {
+		cleanup()
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	printMsg(colorGreen, "\n✓ Conversion completed successfully!")
+	printMsg("", fmt.Sprintf("Location: %s", dst))
+	return nil
+}
+
+// plainToTar writes the data directory into base.tar and the contents of
+// pg_wal into pg_wal.tar, laid out like pg_basebackup -Ft. backup_manifest
+// stays a separate file as in tar-format backups. A backup with tablespaces
+// is refused: their data lies outside it, behind the pg_tblspc links, and a
+// tar backup without <oid>.tar archives for them could not be restored.
+func plainToTar(config *Config, src, dst string) error {
+	if entries, _ := os.ReadDir(filepath.Join(src, "pg_tblspc")); len(entries) > 0 {
+		return fmt.Errorf("backup has %d tablespaces in pg_tblspc, whose data is outside the backup directory; converting them to tar is not supported", len(entries))
+	}
+
+	skipBase := func(rel string) bool {
+		return strings.HasPrefix(rel, "pg_wal/") || rel == "backup_manifest" ||
+			slices.Contains(manifest.MetadataFiles, rel)
+	}
+	if err := writeTar(config, filepath.Join(dst, "base"), src, skipBase); err != nil {
+		return fmt.Errorf("failed to write base archive: %w", err)
+	}
+
+	if err := writeTar(config, filepath.Join(dst, "pg_wal"), filepath.Join(src, "pg_wal"), nil); err != nil {
+		return fmt.Errorf("failed to write WAL archive: %w", err)
+	}
+
+	return copyMetadata(src, dst)
+}
+
+// writeTar archives srcDir into name.tar, or name.tar.gz when compressing.
+func writeTar(config *Config, name, srcDir string, skip func(rel string) bool) error {
+	path := name + ".tar"
+	if config.Compress > 0 {
+		path += ".gz"
+	}
+	printMsg(colorBlue, "Writing "+filepath.Base(path))
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var w io.Writer = out
+	var gzWriter io.WriteCloser
+	if config.Compress > 0 {
+		if gzWriter, err = newGzipWriter(config, out); err != nil {
+			return fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		w = gzWriter
+	}
+
+	tw := tar.NewWriter(w)
+	if err := addDirToTar(tw, srcDir, "", skip); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if gzWriter != nil {
+		if err := gzWriter.Close(); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// tarToPlain unpacks base.tar into dst and pg_wal.tar into dst/pg_wal. The
+// tablespace archives, <oid>.tar, are unpacked into tablespaceDir/<oid>,
+// which dst links to. Without a tablespaceDir a backup with tablespaces is
+// refused: its tablespace_map would make a server started on dst recreate
+// the links to the source's tablespace locations and write to them.
+func tarToPlain(src, dst, tablespaceDir string) error {
+	tablespaces := tablespaceArchives(src)
+	if len(tablespaces) > 0 && tablespaceDir == "" {
+		return fmt.Errorf("backup has %d tablespace archives (<oid>.tar); give --tablespace-dir to unpack them into", len(tablespaces))
+	}
+
+	if err := unpackTar(findTar(src, "base"), dst); err != nil {
+		return err
+	}
+
+	walDir := filepath.Join(dst, "pg_wal")
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		return err
+	}
+	if tarFile := findTar(src, "pg_wal"); tarFile != "" {
+		if err := unpackTar(tarFile, walDir); err != nil {
+			return err
+		}
+	}
+
+	if err := unpackTablespaces(tablespaces, dst, tablespaceDir); err != nil {
+		return err
+	}
+	return copyMetadata(src, dst)
+}
+
+// tablespaceArchives returns the tablespace archives in the tar backup in
+// dir by tablespace OID.
+func tablespaceArchives(dir string) map[string]string {
+	archives := map[string]string{}
+	matches, _ := filepath.Glob(filepath.Join(dir, "[0-9]*.tar*"))
+	for _, match := range matches {
+		oid, _, _ := strings.Cut(filepath.Base(match), ".tar")
+		if _, err := strconv.ParseUint(oid, 10, 32); err != nil {
+			continue
+		}
+		if tarFile := findTar(dir, oid); tarFile != "" {
+			archives[oid] = tarFile
+		}
+	}
+	return archives
+}
+
+// unpackTablespaces unpacks each tablespace archive into tablespaceDir/<oid>,
+// points pg_tblspc/<oid> in dataDir at it and rewrites tablespace_map to
+// match, so recovery recreates the links to these copies.
+func unpackTablespaces(archives map[string]string, dataDir, tablespaceDir string) error {
+	if len(archives) == 0 {
+		return nil
+	}
+	oids := make([]string, 0, len(archives))
+	for oid := range archives {
+		oids = append(oids, oid)
+	}
+	slices.Sort(oids)
+
+	var tablespaceMap strings.Builder
+	for _, oid := range oids {
+		location := filepath.Join(tablespaceDir, oid)
+		if err := os.MkdirAll(location, 0700); err != nil {
+			return err
+		}
+		if err := unpackTar(archives[oid], location); err != nil {
+			return err
+		}
+		if err := relinkTablespace(dataDir, oid, location); err != nil {
+			return err
+		}
+		fmt.Fprintf(&tablespaceMap, "%s %s\n", oid, location)
+	}
+	return os.WriteFile(filepath.Join(dataDir, "tablespace_map"), []byte(tablespaceMap.String()), 0600)
+}
+
+// relinkTablespace points pg_tblspc/<oid> in dataDir at location.
+func relinkTablespace(dataDir, oid, location string) error {
+	link := filepath.Join(dataDir, "pg_tblspc", oid)
+	if err := os.MkdirAll(filepath.Dir(link), 0700); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(link); err != nil {
+		return err
+	}
+	if err := os.Symlink(location, link); err != nil {
+		return fmt.Errorf("failed to link tablespace %s: %w", oid, err)
+	}
+	return nil
+}
+
+// unpackTar extracts a tar, compressed as its extension says, or one split
+// into volumes, into dst, keeping modes, links and modification times.
+func unpackTar(tarFile, dst string) error {
+	printMsg(colorBlue, "Unpacking "+filepath.Base(tarFile))
+
+	file, err := backupfs.OpenVolumes(tarFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := decompress(tarFile, file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return unpackTarStream(tar.NewReader(r), dst)
+}
+
+// decompress wraps r, the contents of tarFile, in the decompressor its
+// extension calls for.
+func decompress(tarFile string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(tarFile, ".gz"):
+		gzReader, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		return gzReader, nil
+	case strings.HasSuffix(tarFile, ".zst"):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd reader: %w", err)
+		}
+		return zr.IOReadCloser(), nil
+	case strings.HasSuffix(tarFile, ".lz4"):
+		return io.NopCloser(lz4.NewReader(r)), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// unpackTarStream extracts every member of tarReader into dst. The
+// pg_tblspc/<oid> links are left to unpackTablespaces.
+func unpackTarStream(tarReader *tar.Reader, dst string) error {
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	dest, err := backupfs.NewDest(dst)
+	if err != nil {
+		return err
+	}
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		target, skip, err := dest.Member(header)
+		if err != nil {
+			return err
+		}
+		if skip {
+			continue
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			os.Remove(target)
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			// A hard link shares the file it names, which must come from
+			// this archive too; Member checked that it does
+			linkTarget := filepath.Join(dst, header.Linkname)
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			if err := os.Link(linkTarget, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tarReader); err != nil {
+				out.Close()
+				return fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+			}
+			if err := out.Close(); err != nil {
+				return err
+			}
+		default:
+			warn(fmt.Sprintf("Skipping unsupported tar member %s", header.Name))
+			continue
+		}
+
+		os.Chtimes(target, header.ModTime, header.ModTime)
+	}
+}
+
+// copyMetadata copies backup_manifest and the files save added to the
+// backup, such as globals.sql, from src to dst. The manifest and
+// SHA256SUMS are written anew by writeConvertedManifest.
+func copyMetadata(src, dst string) error {
+	for _, name := range append([]string{"backup_manifest"}, manifest.MetadataFiles...) {
+		if name == manifest.FileName || name == manifest.ChecksumsFileName || !fileExists(filepath.Join(src, name)) {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, name), filepath.Join(dst, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeConvertedManifest writes a manifest for the converted backup, carrying
+// over what the source manifest knew about the cluster.
+func writeConvertedManifest(config *Config, src, dst string) error {
+	m, err := manifest.Read(src)
+	if err != nil {
+		m = manifest.New()
+	}
+	m.Format = config.Format
+	m.Compress = config.Compress
+	m.Verified = true
+	// The converted files are neither split nor a reindexed or redacted copy
+	m.Volumes = nil
+	m.Reindexed = false
+	m.Redacted = nil
+
+	if config.Format == "plain" {
+		m.Compress = 0
+		m.BackupLabel, _ = backuplabel.ReadFile(filepath.Join(dst, backuplabel.FileName))
+	} else if m.BackupLabel == nil {
+		m.BackupLabel, _ = backuplabel.ReadFile(filepath.Join(src, backuplabel.FileName))
+	}
+
+	if err := m.CollectFiles(dst); err != nil {
+		return err
+	}
+	if err := m.WriteChecksums(dst); err != nil {
+		return err
+	}
+	return m.Write(dst)
+}
+
+// findTar returns the tar file called name in dir under the first of
+// backupfs.TarSuffixes it exists with, including one split into volumes, or
+// "" if there is none.
+func findTar(dir, name string) string {
+	for _, suffix := range backupfs.TarSuffixes {
+		path := filepath.Join(dir, name+suffix)
+		if fileExists(path) || fileExists(manifest.VolumeName(path, 1)) {
+			return path
+		}
+	}
+	return ""
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
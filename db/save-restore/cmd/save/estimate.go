@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// estimateWorkers is how many size queries --parallel-estimate runs at once.
+const estimateWorkers = 4
+
+// namedSize is the size of one database or tablespace. Err is set when the
+// server would not report it.
+type namedSize struct {
+	Name string
+	Size int64
+	Err  error
+}
+
+// sizeEstimate is the breakdown --parallel-estimate prints.
+type sizeEstimate struct {
+	Databases   []namedSize
+	Tablespaces []namedSize
+	WAL         int64
+	WALErr      error
+}
+
+// Total is what the backup is expected to hold. The tablespaces cover every
+// database, templates included, and the shared catalogs in pg_global, so
+// their sum is used when all of them could be measured; otherwise the
+// databases are added up. WAL is added when it could be read.
+func (e *sizeEstimate) Total() int64 {
+	total, complete := int64(0), len(e.Tablespaces) > 0
+	for _, ts := range e.Tablespaces {
+		if ts.Err != nil {
+			complete = false
+		}
+		total += ts.Size
+	}
+	if !complete {
+		total = 0
+		for _, db := range e.Databases {
+			total += db.Size
+		}
+	}
+	if e.WALErr == nil {
+		total += e.WAL
+	}
+	return total
+}
+
+// estimateDetailed measures every database and tablespace and the WAL in
+// pg_wal, running the size queries in parallel since pg_database_size walks
+// every file of a database and is slow on large ones.
+func estimateDetailed(config *Config) (*sizeEstimate, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(estimateWorkers)
+
+	databases, err := queryNames(db, "SELECT datname FROM pg_database ORDER BY datname")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	tablespaces, err := queryNames(db, "SELECT spcname FROM pg_tablespace ORDER BY spcname")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tablespaces: %w", err)
+	}
+
+	estimate := &sizeEstimate{
+		Databases:   make([]namedSize, len(databases)),
+		Tablespaces: make([]namedSize, len(tablespaces)),
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, estimateWorkers)
+	measure := func(target *namedSize, name, query string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			target.Name = name
+			target.Err = db.QueryRow(query, name).Scan(&target.Size)
+		}()
+	}
+	for i, name := range databases {
+		measure(&estimate.Databases[i], name, "SELECT pg_database_size($1)")
+	}
+	for i, name := range tablespaces {
+		measure(&estimate.Tablespaces[i], name, "SELECT pg_tablespace_size($1)")
+	}
+
+	// pg_ls_waldir needs superuser or pg_monitor
+	estimate.WALErr = db.QueryRow("SELECT COALESCE(SUM(size), 0)::bigint FROM pg_ls_waldir()").Scan(&estimate.WAL)
+	wg.Wait()
+
+	sort.SliceStable(estimate.Databases, func(i, j int) bool {
+		return estimate.Databases[i].Size > estimate.Databases[j].Size
+	})
+	return estimate, nil
+}
+
+// queryNames returns the single text column of query.
+func queryNames(db *sql.DB, query string) ([]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// printEstimate prints the breakdown of a detailed estimate.
+func printEstimate(e *sizeEstimate) {
+	fmt.Println("Estimated backup size:")
+	list := func(heading string, sizes []namedSize) {
+		fmt.Printf("  %s:\n", heading)
+		for _, s := range sizes {
+			if s.Err != nil {
+				fmt.Printf("    %-30s unknown (%v)\n", s.Name, s.Err)
+			} else {
+				fmt.Printf("    %-30s %s\n", s.Name, formatBytes(s.Size))
+			}
+		}
+	}
+	list("Databases", e.Databases)
+	list("Tablespaces", e.Tablespaces)
+	if e.WALErr != nil {
+		fmt.Printf("  %-32s unknown (%v)\n", "WAL in pg_wal:", e.WALErr)
+	} else {
+		fmt.Printf("  %-32s %s\n", "WAL in pg_wal:", formatBytes(e.WAL))
+	}
+	printMsg(colorBlue, fmt.Sprintf("Estimated total: %s", formatBytes(e.Total())))
+}
+
+// checkFreeSpace checks that the file system the backup is written to has
+// room for size bytes. Compressed backups are usually much smaller than the
+// estimate, so for those a shortfall only warns.
+func checkFreeSpace(config *Config, size int64) error {
+	dir := backupRoot(config)
+	// The backup directory may not exist yet
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+
+	free, err := freeSpace(dir)
+	if err != nil {
+		warn(fmt.Sprintf("Could not check free space in %s: %v", dir, err))
+		return nil
+	}
+	if free >= size {
+		printMsg(colorGreen, fmt.Sprintf("✓ %s free in %s", formatBytes(free), dir))
+		return nil
+	}
+
+	compressed := config.ArchiveTar || (config.Format == "tar" && config.Compress > 0)
+	if compressed {
+		warn(fmt.Sprintf("Only %s free in %s for an estimated %s before compression", formatBytes(free), dir, formatBytes(size)))
+		return nil
+	}
+	return fmt.Errorf("only %s free in %s, the backup needs about %s", formatBytes(free), dir, formatBytes(size))
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// requiredPaths are data directory entries PostgreSQL cannot start without.
+// An exclusion pattern matching any of them (or one of their parents) is
+// refused. Their contents may still be excluded where that is safe, e.g.
+// "pg_replslot/*" drops the slots but keeps the directory.
+var requiredPaths = []string{
+	"PG_VERSION",
+	"backup_label",
+	"tablespace_map",
+	// The configuration lives in the data directory in the official
+	// Docker image's layout
+	"postgresql.conf",
+	"postgresql.auto.conf",
+	"pg_hba.conf",
+	"pg_ident.conf",
+	"global",
+	"global/pg_control",
+	"global/pg_filenode.map",
+	"base",
+	"pg_wal",
+	"pg_xact",
+	"pg_multixact",
+	"pg_multixact/members",
+	"pg_multixact/offsets",
+	"pg_commit_ts",
+	"pg_subtrans",
+	"pg_twophase",
+	"pg_tblspc",
+	"pg_logical",
+	"pg_logical/snapshots",
+	"pg_logical/mappings",
+	"pg_replslot",
+	"pg_snapshots",
+	"pg_serial",
+	"pg_notify",
+	"pg_dynshmem",
+	"pg_stat",
+	"pg_stat_tmp",
+}
+
+// protectedTrees are directories whose contents are all needed; nothing
+// below them is ever excluded.
+var protectedTrees = []string{
+	"base",
+	"global",
+	"pg_wal",
+	"pg_xact",
+	"pg_multixact",
+	"pg_commit_ts",
+	"pg_twophase",
+	"pg_tblspc",
+}
+
+// validateExcludes checks that every pattern is well formed and that none of
+// them would remove something required for a valid backup.
+func validateExcludes(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+
+		clean := strings.Trim(strings.TrimPrefix(pattern, "./"), "/")
+		if first, _, nested := strings.Cut(clean, "/"); nested {
+			for _, tree := range protectedTrees {
+				if ok, _ := path.Match(first, tree); ok {
+					return fmt.Errorf("exclude pattern %q reaches into %s, which is required for a valid backup", pattern, tree)
+				}
+			}
+		}
+
+		for _, required := range requiredPaths {
+			if isExcluded([]string{pattern}, required) {
+				return fmt.Errorf("exclude pattern %q would drop %s, which is required for a valid backup", pattern, required)
+			}
+		}
+	}
+	return nil
+}
+
+// isExcluded reports whether name, a slash-separated path relative to the
+// data directory, matches a pattern itself or lies under a path that does.
+// Patterns without a slash also match against the final path element.
+func isExcluded(patterns []string, name string) bool {
+	name = strings.Trim(strings.TrimPrefix(name, "./"), "/")
+	if name == "" || name == "." {
+		return false
+	}
+
+	first, _, _ := strings.Cut(name, "/")
+	for _, tree := range protectedTrees {
+		if first == tree && name != tree {
+			return false
+		}
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.Trim(strings.TrimPrefix(pattern, "./"), "/")
+		for p := name; p != "."; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+			if !strings.Contains(pattern, "/") {
+				if ok, _ := path.Match(pattern, path.Base(p)); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// applyExcludes removes excluded paths from a finished backup. pg_basebackup
+// has no client-side exclusion option, so tar archives are rewritten without
+// the excluded members and plain backups have the files deleted in place.
+func applyExcludes(config *Config, backupPath string) error {
+	if len(config.Exclude) == 0 {
+		return nil
+	}
+
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would exclude: "+strings.Join(config.Exclude, ", "))
+		return nil
+	}
+
+	printMsg(colorBlue, "\nApplying exclusions: "+strings.Join(config.Exclude, ", "))
+
+	var removed int
+	var err error
+	if config.Format == "tar" {
+		removed, err = excludeFromTars(config, backupPath)
+	} else {
+		removed, err = excludeFromPlain(config, backupPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	printMsg(colorGreen, fmt.Sprintf("✓ Excluded %d entries", removed))
+	if _, err := os.Stat(filepath.Join(backupPath, "backup_manifest")); err == nil && removed > 0 {
+		warn("backup_manifest still lists excluded files; pg_verifybackup will report them as missing")
+	}
+
+	return nil
+}
+
+func excludeFromPlain(config *Config, backupPath string) (int, error) {
+	removed := 0
+	err := filepath.Walk(backupPath, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(backupPath, p)
+		if err != nil {
+			return err
+		}
+		if !isExcluded(config.Exclude, filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", p, err)
+		}
+		removed++
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func excludeFromTars(config *Config, backupPath string) (int, error) {
+	// Only the main data directory archive is filtered; WAL and tablespace
+	// archives hold nothing that is safe to drop.
+	tarFiles, err := filepath.Glob(filepath.Join(backupPath, "base.tar*"))
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, tarFile := range tarFiles {
+		n, err := rewriteTar(config, tarFile)
+		if err != nil {
+			return removed, fmt.Errorf("failed to filter %s: %w", filepath.Base(tarFile), err)
+		}
+		removed += n
+	}
+	return removed, nil
+}
+
+// rewriteTar copies tarFile to a temporary file without the excluded members
+// and then replaces the original with it.
+func rewriteTar(config *Config, tarFile string) (int, error) {
+	in, err := os.Open(tarFile)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	tmpFile := tarFile + ".tmp"
+	out, err := os.Create(tmpFile)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmpFile)
+	defer out.Close()
+
+	compressed := strings.HasSuffix(tarFile, ".gz")
+
+	var src io.Reader = in
+	var dst io.Writer = out
+	var gzWriter io.WriteCloser
+	if compressed {
+		gzReader, err := gzip.NewReader(in)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create gzip reader: %w", err)
+		}
+		defer gzReader.Close()
+		src = gzReader
+
+		gzWriter, err = newGzipWriter(config, out)
+		if err != nil {
+			return 0, fmt.Errorf("failed to create gzip writer: %w", err)
+		}
+		dst = gzWriter
+	}
+
+	tarReader := tar.NewReader(src)
+	tarWriter := tar.NewWriter(dst)
+
+	removed := 0
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return removed, fmt.Errorf("failed to read tar header: %w", err)
+		}
+
+		if isExcluded(config.Exclude, header.Name) {
+			removed++
+			continue
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return removed, fmt.Errorf("failed to write tar header: %w", err)
+		}
+		if _, err := io.Copy(tarWriter, tarReader); err != nil {
+			return removed, fmt.Errorf("failed to copy %s: %w", header.Name, err)
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return removed, err
+	}
+	if gzWriter != nil {
+		if err := gzWriter.Close(); err != nil {
+			return removed, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return removed, err
+	}
+
+	if err := os.Rename(tmpFile, tarFile); err != nil {
+		return removed, fmt.Errorf("failed to replace archive: %w", err)
+	}
+	return removed, nil
+}
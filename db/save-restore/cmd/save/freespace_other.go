@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd || dragonfly)
+
+package main
+
+import "errors"
+
+// freeSpace is only implemented where syscall.Statfs reports Bavail and
+// Bsize; elsewhere the free space is unknown.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.New("free space is unknown on this platform")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// dumpGlobals implements --dump-globals: it writes the roles, role
+// memberships and tablespace definitions of the source with pg_dumpall
+// --globals-only into globals.sql of the backup. The base backup holds them
+// too, but only in a form a physical restore can use.
+func dumpGlobals(config *Config, backupPath string) error {
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would dump roles and tablespaces to "+manifest.GlobalsFileName)
+		return nil
+	}
+
+	printMsg(colorBlue, "\nDumping roles and tablespaces...")
+	cmd := exec.Command("pg_dumpall", "--globals-only",
+		"-h", config.Host,
+		"-p", strconv.Itoa(config.Port),
+		"-U", config.User,
+		"-l", config.Database,
+		"-f", filepath.Join(backupPath, manifest.GlobalsFileName))
+	cmd.Env = append(os.Environ(), serviceEnv(config)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if strings.Contains(message, "pg_authid") {
+			message += " (reading role passwords needs superuser)"
+		}
+		return fmt.Errorf("pg_dumpall failed: %w: %s", err, message)
+	}
+
+	printMsg(colorGreen, "✓ Dumped roles and tablespaces to "+manifest.GlobalsFileName)
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// defaultSharedBuffers is PostgreSQL's shared_buffers when nothing sets it.
+const defaultSharedBuffers = 128 << 20
+
+// minOpenFiles is roughly how many file descriptors the postmaster wants
+// before it starts ("insufficient file descriptors available to start
+// server process").
+const minOpenFiles = 64
+
+// serverMemory is what the scratch server will ask the kernel for.
+type serverMemory struct {
+	SharedBuffers    int64
+	Source           string // where SharedBuffers came from
+	SharedMemoryType string // "mmap" or "sysv"
+	HugePages        string // "try", "on" or "off"
+}
+
+// needed estimates the main shared memory segment: shared_buffers plus
+// room for the lock tables, WAL buffers and the other shared structures.
+func (s *serverMemory) needed() int64 {
+	return s.SharedBuffers + s.SharedBuffers/16 + 16<<20
+}
+
+// checkServerLimits compares the host's limits with the shared memory the
+// scratch server will allocate for the restored cluster, so a server that
+// cannot start here is reported as a host problem instead of a failed
+// restore. Limits that cannot be read are skipped. Problems that stop the
+// server from starting are returned unless ignore is set; the rest only warn.
+func checkServerLimits(backup, dataDir string, ignore bool) error {
+	mem := restoredServerMemory(backup, dataDir)
+	needed := mem.needed()
+	printMsg(colorBlue, fmt.Sprintf("Checking host limits for shared_buffers %s (%s), about %s of shared memory...",
+		formatBytes(mem.SharedBuffers), mem.Source, formatBytes(needed)))
+
+	var problems []string
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	checkRlimits(needed, problem)
+
+	// With the default mmap shared memory only a tiny System V segment is
+	// used, so shmmax and shmall only matter for shared_memory_type = sysv
+	if mem.SharedMemoryType == "sysv" {
+		if shmmax, ok := readProcInt("/proc/sys/kernel/shmmax"); ok && shmmax < needed {
+			problem("kernel.shmmax is %s but shared_memory_type = sysv needs a %s segment", formatBytes(shmmax), formatBytes(needed))
+		}
+		if shmall, ok := readProcInt("/proc/sys/kernel/shmall"); ok && shmall*int64(os.Getpagesize()) < needed {
+			problem("kernel.shmall allows %s of shared memory, below the %s needed", formatBytes(shmall*int64(os.Getpagesize())), formatBytes(needed))
+		}
+	}
+
+	meminfo := readMeminfo()
+	if mem.HugePages == "on" {
+		if free, ok := meminfo["HugePages_Free"]; ok {
+			available := free * meminfo["Hugepagesize"]
+			if available < needed {
+				problem("huge_pages = on but only %s of huge pages are free (vm.nr_hugepages)", formatBytes(available))
+			}
+		}
+	}
+	if overcommit, ok := readProcInt("/proc/sys/vm/overcommit_memory"); ok && overcommit == 2 {
+		if limit, ok := meminfo["CommitLimit"]; ok {
+			if free := limit - meminfo["Committed_AS"]; free < needed {
+				problem("vm.overcommit_memory = 2 leaves %s to commit, below the %s needed", formatBytes(max(free, 0)), formatBytes(needed))
+			}
+		}
+	}
+
+	if available, ok := meminfo["MemAvailable"]; ok && available < needed {
+		warn(fmt.Sprintf("Only %s of memory is available; the scratch server may start but fail once it fills shared_buffers", formatBytes(available)))
+	}
+	if limit, ok := cgroupMemoryLimit(); ok && limit < needed {
+		warn(fmt.Sprintf("The memory limit of this container is %s; the scratch server may be killed once it fills shared_buffers", formatBytes(limit)))
+	}
+
+	if len(problems) == 0 {
+		printMsg(colorGreen, "✓ Host limits allow the scratch server to start")
+		return nil
+	}
+	for _, p := range problems {
+		if ignore {
+			warn(p + " (ignored with --ignore-resource-limits)")
+		} else {
+			printMsg(colorRed, "✗ "+p)
+		}
+	}
+	if ignore {
+		return nil
+	}
+	return fmt.Errorf("this host cannot start the scratch server with shared_buffers %s; raise the limits above or lower shared_buffers in the backup's postgresql.conf (--ignore-resource-limits starts it anyway)",
+		formatBytes(mem.SharedBuffers))
+}
+
+// restoredServerMemory works out the shared memory settings the scratch
+// server will run with: shared_buffers as recorded in the manifest by
+// --record-source-settings, else as set in the restored configuration
+// files, else PostgreSQL's default.
+func restoredServerMemory(backup, dataDir string) *serverMemory {
+	mem := &serverMemory{SharedBuffers: defaultSharedBuffers, Source: "PostgreSQL default", SharedMemoryType: "mmap", HugePages: "try"}
+
+	conf := readConfSettings(dataDir)
+	if value, ok := conf["shared_buffers"]; ok {
+		if size, ok := parseMemorySetting(value); ok {
+			mem.SharedBuffers, mem.Source = size, "postgresql.conf"
+		}
+	}
+	var recorded map[string]string
+	if m, err := manifest.Read(backup); err == nil {
+		recorded = m.Settings
+	}
+	if value, ok := recorded["shared_buffers"]; ok {
+		if size, ok := parseMemorySetting(value); ok {
+			mem.SharedBuffers, mem.Source = size, "recorded in the manifest"
+		}
+	}
+
+	for name, target := range map[string]*string{"shared_memory_type": &mem.SharedMemoryType, "huge_pages": &mem.HugePages} {
+		if value, ok := recorded[name]; ok {
+			*target = strings.ToLower(value)
+		} else if value, ok := conf[name]; ok {
+			*target = strings.ToLower(value)
+		}
+	}
+	return mem
+}
+
+// readConfSettings returns the settings in the data directory's
+// postgresql.conf and postgresql.auto.conf, later ones winning as they do
+// for the server. Included files are not followed.
+func readConfSettings(dataDir string) map[string]string {
+	settings := map[string]string{}
+	for _, name := range []string{"postgresql.conf", "postgresql.auto.conf"} {
+		f, err := os.Open(filepath.Join(dataDir, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line, _, _ := strings.Cut(scanner.Text(), "#")
+			key, value, found := strings.Cut(line, "=")
+			if !found {
+				key, value, found = strings.Cut(strings.TrimSpace(line), " ")
+			}
+			if !found {
+				continue
+			}
+			settings[strings.ToLower(strings.TrimSpace(key))] = strings.Trim(strings.TrimSpace(value), "'")
+		}
+		f.Close()
+	}
+	return settings
+}
+
+// parseMemorySetting parses a memory setting such as "8GB" or "16384" the
+// way PostgreSQL does for shared_buffers: without a unit it counts 8kB
+// blocks.
+func parseMemorySetting(value string) (int64, bool) {
+	value = strings.TrimSpace(value)
+	i := 0
+	for i < len(value) && value[i] >= '0' && value[i] <= '9' {
+		i++
+	}
+	n, err := strconv.ParseInt(value[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	units := map[string]int64{"": 8 << 10, "B": 1, "kB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "TB": 1 << 40}
+	unit, ok := units[strings.TrimSpace(value[i:])]
+	if !ok {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// readMeminfo returns /proc/meminfo with the kB values in bytes. Counts
+// such as HugePages_Free are kept as they are.
+func readMeminfo() map[string]int64 {
+	info := map[string]int64{}
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return info
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) > 2 && fields[2] == "kB" {
+			n *= 1024
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = n
+	}
+	return info
+}
+
+// cgroupMemoryLimit returns the memory limit of the cgroup this process
+// runs in, for cgroup v2 and v1.
+func cgroupMemoryLimit() (int64, bool) {
+	for _, path := range []string{"/sys/fs/cgroup/memory.max", "/sys/fs/cgroup/memory/memory.limit_in_bytes"} {
+		if limit, ok := readProcInt(path); ok {
+			// v1 reports "no limit" as a huge number rounded to the page size
+			if limit >= 1<<62 {
+				return 0, false
+			}
+			return limit, true
+		}
+	}
+	return 0, false
+}
+
+// readProcInt reads a file holding a single number, such as a sysctl.
+func readProcInt(path string) (int64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,7 @@
+//go:build !unix || openbsd
+
+package main
+
+// checkRlimits is only implemented on Unix systems with RLIMIT_AS, which
+// OpenBSD lacks; elsewhere no resource limits are checked.
+func checkRlimits(needed int64, problem func(format string, args ...any)) {}
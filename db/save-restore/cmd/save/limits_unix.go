@@ -0,0 +1,19 @@
+//go:build unix && !openbsd
+
+package main
+
+import "syscall"
+
+// checkRlimits reports resource limits of this process, which the scratch
+// server inherits, that are too low for it to start with needed bytes of
+// shared memory.
+func checkRlimits(needed int64, problem func(format string, args ...any)) {
+	var rlimit syscall.Rlimit
+	// An unlimited RLIMIT_AS (RLIM_INFINITY) reads as -1
+	if err := syscall.Getrlimit(syscall.RLIMIT_AS, &rlimit); err == nil && int64(rlimit.Cur) > 0 && int64(rlimit.Cur) < needed {
+		problem("the address space limit (ulimit -v) is %s, below the %s the server needs", formatBytes(int64(rlimit.Cur)), formatBytes(needed))
+	}
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err == nil && rlimit.Cur < minOpenFiles {
+		problem("the open file limit (ulimit -n) is %d, PostgreSQL needs at least %d", rlimit.Cur, minOpenFiles)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// listEntry is one backup as shown by `save list --output json`.
+type listEntry struct {
+	Name    string    `json:"name"`
+	Path    string    `json:"path"`
+	Created time.Time `json:"created"`
+	Size    int64     `json:"size"`
+	Format  string    `json:"format,omitempty"`
+	Archive bool      `json:"archive"`
+	Status  string    `json:"status"`
+	Problem string    `json:"problem,omitempty"`
+}
+
+// runList implements `save list`, which shows every backup in the backup
+// directory, newest first, and whether it is complete, partial or unknown.
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	backupDir := fs.String("backup-dir", "backups", "Backup directory")
+	output := fs.String("output", "text", "Output format (text or json)")
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Parse(args)
+
+	if *output != "text" && *output != "json" {
+		return fmt.Errorf("--output must be text or json")
+	}
+
+	backups, err := scanRepository(*backupDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", *backupDir, err)
+	}
+
+	if *output == "json" {
+		entries := []listEntry{}
+		for _, b := range backups {
+			e := listEntry{Name: b.Name, Path: b.Path, Created: b.Created, Size: b.Size,
+				Archive: b.Archive, Status: b.Status, Problem: b.Problem}
+			if b.Manifest != nil {
+				e.Format = b.Manifest.Format
+			}
+			entries = append(entries, e)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(entries)
+	}
+
+	if len(backups) == 0 {
+		printMsg(colorYellow, "No backups found in "+*backupDir)
+		return nil
+	}
+
+	fmt.Println(ui.Colorize(colorBold, fmt.Sprintf("%-42s %-19s %-10s %-8s %s", "NAME", "CREATED", "SIZE", "FORMAT", "STATUS")))
+	var partial int
+	for _, b := range backups {
+		format := "-"
+		switch {
+		case b.Archive:
+			format = "archive"
+		case b.Manifest != nil:
+			format = b.Manifest.Format
+		}
+
+		status := b.Status
+		if b.Problem != "" {
+			status += ": " + b.Problem
+		}
+		line := fmt.Sprintf("%-42s %-19s %-10s %-8s %s", b.Name, b.Created.Format("2006-01-02 15:04:05"), formatBytes(b.Size), format, status)
+
+		switch b.Status {
+		case statusPartial:
+			partial++
+			printMsg(colorRed, line)
+		case statusUnknown:
+			printMsg(colorYellow, line)
+		default:
+			fmt.Println(line)
+		}
+	}
+
+	if partial > 0 {
+		printMsg(colorYellow, fmt.Sprintf("\n%d partial backups; do not restore them. Remove them with `save prune --remove-partial --delete`.", partial))
+	}
+	return nil
+}
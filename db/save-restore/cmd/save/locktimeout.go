@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// startupPollInterval is how often the backup's start is checked once
+// --lock-timeout has passed.
+const startupPollInterval = time.Second
+
+// progressViewVersion is the server_version_num from which
+// pg_stat_progress_basebackup exists (PostgreSQL 13).
+const progressViewVersion = 130000
+
+// lockTimeoutOption returns the libpq options value that sets lock_timeout
+// for --lock-timeout, or "" without it.
+func lockTimeoutOption(config *Config) string {
+	if config.LockTimeout <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("-c lock_timeout=%d", config.LockTimeout.Milliseconds())
+}
+
+// baseBackupEnv returns the environment pg_basebackup runs with: its
+// connections carry lock_timeout in PGOPTIONS and appName, so the backup
+// can be told apart from other base backups in pg_stat_activity, and use
+// --service like save's own.
+func baseBackupEnv(config *Config, appName string) []string {
+	env := append(os.Environ(), "PGAPPNAME="+appName)
+	env = append(env, serviceEnv(config)...)
+	if option := lockTimeoutOption(config); option != "" {
+		env = append(env, "PGOPTIONS="+strings.TrimSpace(os.Getenv("PGOPTIONS")+" "+option))
+	}
+	return env
+}
+
+// watchBackupStart fails the backup once it has not got past its start for
+// --lock-timeout: while its connection waits on a lock held by another
+// session, or on the forced checkpoint with --checkpoint fast. lock_timeout
+// only covers heavyweight locks, so the checks are made here. process is
+// killed and the returned function, called after it exited, reports why.
+// A spread checkpoint may take long by design and only gets a notice.
+// Before PostgreSQL 13 the checkpoint cannot be seen, only the locks.
+func watchBackupStart(config *Config, appName string, process *os.Process) func() error {
+	if config.LockTimeout <= 0 {
+		return func() error { return nil }
+	}
+
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	var reason error
+	go func() {
+		defer close(finished)
+		select {
+		case <-stop:
+			return
+		case <-time.After(config.LockTimeout):
+		}
+
+		unavailable := func(err error) {
+			warn(fmt.Sprintf("Cannot watch the backup's start for --lock-timeout: %v", err))
+		}
+		db, err := sql.Open("postgres", connString(config))
+		if err != nil {
+			unavailable(err)
+			return
+		}
+		defer db.Close()
+
+		var versionNum int
+		if err := db.QueryRow("SHOW server_version_num").Scan(&versionNum); err != nil {
+			unavailable(err)
+			return
+		}
+		withPhase := versionNum >= progressViewVersion
+
+		notified := false
+		ticker := time.NewTicker(startupPollInterval)
+		defer ticker.Stop()
+		for {
+			phase, blockers, err := backupStartState(db, appName, withPhase)
+			if err != nil {
+				unavailable(err)
+				return
+			}
+			switch {
+			case len(blockers) > 0:
+				reason = fmt.Errorf("could not acquire lock within %s: blocked by %s", config.LockTimeout, describeSessions(db, blockers))
+			case phase == "waiting for checkpoint to finish" && config.Checkpoint == "fast":
+				reason = fmt.Errorf("the forced checkpoint has not finished after %s; check the server's I/O and log", config.LockTimeout)
+			case phase == "waiting for checkpoint to finish":
+				if !notified {
+					printMsg(colorYellow, fmt.Sprintf("\nStill waiting for the spread checkpoint after %s (--checkpoint fast starts at once)", config.LockTimeout))
+					notified = true
+				}
+			case phase != "" && phase != "initializing":
+				// Past the checkpoint, the backup is under way
+				return
+			}
+			if reason != nil {
+				process.Kill()
+				return
+			}
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		<-finished
+		return reason
+	}
+}
+
+// backupStartState returns the pg_stat_progress_basebackup phase of the
+// backup's connection and the sessions blocking it. Without withPhase, for
+// servers that lack the view, the phase is always "".
+func backupStartState(db *sql.DB, appName string, withPhase bool) (string, []int64, error) {
+	query := `
+		SELECT '', pg_blocking_pids(a.pid)
+		FROM pg_stat_activity a
+		WHERE a.application_name = $1`
+	if withPhase {
+		query = `
+		SELECT COALESCE(p.phase, ''), pg_blocking_pids(a.pid)
+		FROM pg_stat_activity a
+		LEFT JOIN pg_stat_progress_basebackup p USING (pid)
+		WHERE a.application_name = $1`
+	}
+	rows, err := db.Query(query, appName)
+	if err != nil {
+		return "", nil, err
+	}
+	defer rows.Close()
+
+	var phase string
+	var blockers []int64
+	for rows.Next() {
+		var p string
+		var pids pq.Int64Array
+		if err := rows.Scan(&p, &pids); err != nil {
+			return "", nil, err
+		}
+		if p != "" {
+			phase = p
+		}
+		blockers = append(blockers, pids...)
+	}
+	return phase, blockers, rows.Err()
+}
+
+// describeSessions names the sessions with the given PIDs for an error
+// message, with their user, transaction age and query.
+func describeSessions(db *sql.DB, pids []int64) string {
+	rows, err := db.Query(`
+		SELECT pid, COALESCE(usename, ''), COALESCE(EXTRACT(EPOCH FROM now() - xact_start)::bigint, 0), LEFT(query, 80)
+		FROM pg_stat_activity WHERE pid = ANY($1)`, pq.Int64Array(pids))
+	if err != nil {
+		return fmt.Sprintf("PID %v", pids)
+	}
+	defer rows.Close()
+
+	var sessions []string
+	for rows.Next() {
+		var pid, age int64
+		var user, query string
+		if err := rows.Scan(&pid, &user, &age, &query); err != nil {
+			break
+		}
+		sessions = append(sessions, fmt.Sprintf("PID %d (user %s, transaction open %s: %s)", pid, user, time.Duration(age)*time.Second, query))
+	}
+	if len(sessions) == 0 {
+		return fmt.Sprintf("PID %v", pids)
+	}
+	return strings.Join(sessions, ", ")
+}
+
+// reportLongTransactions lists the transactions open for longer than
+// --lock-timeout as a heads-up: the backup's start may wait behind them.
+func reportLongTransactions(config *Config, db *sql.DB) {
+	rows, err := db.Query(`
+		SELECT pid, COALESCE(usename, ''), EXTRACT(EPOCH FROM now() - xact_start)::bigint, COALESCE(state, ''), LEFT(query, 80)
+		FROM pg_stat_activity
+		WHERE xact_start < now() - $1 * interval '1 millisecond' AND pid <> pg_backend_pid()
+		ORDER BY xact_start`, config.LockTimeout.Milliseconds())
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pid, age int64
+		var user, state, query string
+		if err := rows.Scan(&pid, &user, &age, &state, &query); err != nil {
+			return
+		}
+		printMsg(colorYellow, fmt.Sprintf("Long-running transaction: PID %d (user %s, %s) open for %s: %s", pid, user, state, time.Duration(age)*time.Second, query))
+	}
+}
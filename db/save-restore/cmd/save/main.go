@@ -2,7 +2,8 @@ package main
 
 import (
 	"bufio"
-	"context"
+	"bytes"
+	"compress/gzip"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -16,36 +17,158 @@ import (
 	"time"
 
 	_ "github.com/lib/pq"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/backuplabel"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/report"
+	"github.com/timescaledb-tools/save-restore/internal/sentinel"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
 )
 
 const (
-	colorGreen  = "\033[0;32m"
-	colorYellow = "\033[1;33m"
-	colorRed    = "\033[0;31m"
-	colorBlue   = "\033[0;34m"
-	colorReset  = "\033[0m"
+	colorGreen  = ui.Green
+	colorYellow = ui.Yellow
+	colorRed    = ui.Red
+	colorBlue   = ui.Blue
+	colorBold   = ui.Bold
 )
 
 type Config struct {
-	Host       string
-	Port       int
-	User       string
-	Password   string
-	Database   string
-	BackupDir  string
+	Host      string
+	Port      int
+	User      string
+	Password  string
+	Database  string
+	BackupDir string
+
+	// Service is the --service the connection settings come from,
+	// ServiceFile the PGSERVICEFILE it was looked up in, if any, and
+	// SSLMode the sslmode of save's own connections.
+	Service     string
+	ServiceFile string
+	SSLMode     string
+
 	Format     string
 	Compress   int
 	NoProgress bool
 	Checkpoint string
 	DryRun     bool
+	Exclude    stringList
+	OnFailure  string
+	ArchiveTar bool
+	NoVerify   bool
+	SplitSize  int64
+	OutputDir  string
+
+	// CompressImpl, CompressWorkers and ArchiveLevel tune the compression
+	// save does itself rather than pg_basebackup.
+	CompressImpl    string
+	CompressWorkers int
+	ArchiveLevel    int
+
+	ConnectRetries    int
+	ConnectRetryDelay time.Duration
+
+	VerifyByRestore bool
+	TestRestore     testRestoreOptions
+
+	SkipIfUnchanged bool
+	SkipThreshold   int64
+
+	ParallelEstimate bool
+	LockTimeout      time.Duration
+	MaxClockSkew     time.Duration
+
+	RecordSourceSettings bool
+	SourceSettings       stringList
+	RecommendedConf      bool
+
+	RedactManifest bool
+	RedactFields   stringList
+	RedactHash     bool
+
+	WALArchiveDir string
+
+	Runbook     bool
+	DumpGlobals bool
+
+	Sentinel string
+	Report   string
+}
+
+// BackupResult describes a backup created by pg_basebackup.
+type BackupResult struct {
+	Path     string
+	Archive  string
+	StartLSN string
+	StopLSN  string
+	Timeline int
+	Label    *backuplabel.Label
+	Verified bool
+	Volumes  []manifest.Volume
+	Size     int64
+
+	// PGVersion and TimescaleDB are the source's versions as recorded in
+	// the manifest, for the run's summary.
+	PGVersion   string
+	TimescaleDB string
+
+	// Clock is the clock comparison of the connection check.
+	Clock *manifest.Clock
+
+	// Manifest is the manifest written into the backup.
+	Manifest *manifest.Manifest
+}
+
+// stringList collects the values of a repeatable flag.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// commands are the subcommands of the save tool. Without one, save creates a
+// backup.
+var commands = map[string]func(args []string) error{
+	"benchmark":    runBenchmark,
+	"convert":      runConvert,
+	"list":         runList,
+	"prune":        runPrune,
+	"redact":       runRedact,
+	"reindex":      runReindex,
+	"runbook":      runRunbook,
+	"test-restore": runTestRestore,
 }
 
 func main() {
+	takeServiceEnv()
+
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			if err := ui.StrictError(); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+
 	config := parseFlags()
 
 	if err := run(config); err != nil {
 		log.Fatal(err)
 	}
+	if err := ui.StrictError(); err != nil {
+		log.Fatal(err)
+	}
 }
 
 func parseFlags() *Config {
@@ -54,17 +177,69 @@ func parseFlags() *Config {
 	flag.StringVar(&config.Host, "host", getEnv("PGHOST", "localhost"), "PostgreSQL host")
 	flag.IntVar(&config.Port, "port", getEnvInt("PGPORT", 5432), "PostgreSQL port")
 	flag.StringVar(&config.User, "user", getEnv("PGUSER", "postgres"), "PostgreSQL user")
-	flag.StringVar(&config.Password, "password", getEnv("PGPASSWORD", ""), "PostgreSQL password")
+	flag.StringVar(&config.Password, "password", getEnv("PGPASSWORD", ""), "PostgreSQL password, or a vault:// or awssm:// secret reference")
 	flag.StringVar(&config.Database, "database", getEnv("PGDATABASE", "postgres"), "PostgreSQL database")
+	addServiceFlag(flag.CommandLine, config)
 	flag.StringVar(&config.BackupDir, "backup-dir", "backups", "Backup directory")
+	flag.StringVar(&config.OutputDir, "output-dir", "", "Exact directory to write the backup to, instead of a timestamped one in --backup-dir")
 	flag.StringVar(&config.Format, "format", "tar", "Backup format (tar or plain)")
 	flag.IntVar(&config.Compress, "compress", 6, "Compression level (0-9)")
 	flag.BoolVar(&config.NoProgress, "no-progress", false, "Disable progress reporting")
 	flag.StringVar(&config.Checkpoint, "checkpoint", "fast", "Checkpoint mode (fast or spread)")
 	flag.BoolVar(&config.DryRun, "dry-run", false, "Dry run mode")
+	flag.Var(&config.Exclude, "exclude", "Glob of data directory paths to drop from the backup (repeatable)")
+	flag.StringVar(&config.OnFailure, "on-failure", "cleanup", "What to do with a failed backup (cleanup or keep)")
+	flag.BoolVar(&config.ArchiveTar, "archive-tar", false, "Package a tar-format backup into a single .tar.zst archive")
+	flag.IntVar(&config.ArchiveLevel, "archive-level", defaultArchiveLevel, "zstd level of the --archive-tar archive (1-22)")
+	addCompressFlags(flag.CommandLine, config)
+	flag.Int64Var(&config.SplitSize, "split-size", 0, "Split tar files larger than this many bytes into numbered volumes (0 disables)")
+	flag.BoolVar(&config.NoVerify, "no-verify", false, "Skip post-backup verification (faster, but the backup is not checked)")
+	flag.IntVar(&config.ConnectRetries, "connect-retries", 0, "Retry the initial connection this many times on connection errors")
+	flag.DurationVar(&config.ConnectRetryDelay, "connect-retry-delay", 2*time.Second, "Delay between --connect-retries attempts")
+	flag.DurationVar(&config.LockTimeout, "lock-timeout", 0, "Fail the backup if its start waits longer than this on a lock or the forced checkpoint, e.g. 30s (0 waits forever)")
+	flag.DurationVar(&config.MaxClockSkew, "max-clock-skew", 5*time.Second, "Warn if the server's clock differs from this host's by more than this (0 disables the warning)")
+	flag.BoolVar(&config.ParallelEstimate, "parallel-estimate", false, "Estimate the backup size per database and tablespace, including WAL, with parallel queries, and print the breakdown")
+	flag.BoolVar(&config.SkipIfUnchanged, "skip-if-unchanged", false, "Skip the backup if little WAL was written since the last one")
+	flag.Int64Var(&config.SkipThreshold, "skip-threshold", 1024*1024, "WAL bytes since the last backup below which --skip-if-unchanged skips")
+
+	flag.BoolVar(&config.RecordSourceSettings, "record-source-settings", false, "Record key server settings of the source in the manifest")
+	flag.Var(&config.SourceSettings, "source-setting", "Setting or glob of settings to record instead of the defaults (repeatable, e.g. 'timescaledb.*')")
+	flag.BoolVar(&config.RecommendedConf, "recommended-conf", false, "With --record-source-settings, also write the settings to "+manifest.SettingsFileName)
+
+	flag.BoolVar(&config.RedactManifest, "redact-manifest", false, "Also write "+manifest.RedactedFileName+", a copy of the manifest without host, database and setting details")
+	flag.Var(&config.RedactFields, "redact-field", "With --redact-manifest, manifest field to redact instead of the defaults (repeatable)")
+	flag.BoolVar(&config.RedactHash, "redact-hash", false, "With --redact-manifest, hash redacted strings instead of removing them")
+
+	flag.BoolVar(&config.Runbook, "runbook", false, "Also write "+manifest.RunbookFileName+" with the commands to restore this backup")
+	flag.BoolVar(&config.DumpGlobals, "dump-globals", false, "Also dump roles and tablespaces with pg_dumpall --globals-only into "+manifest.GlobalsFileName)
+	flag.StringVar(&config.WALArchiveDir, "wal-archive-dir", "", "Also copy the backup's completed WAL segments into this WAL archive for point-in-time recovery; WAL written after the backup is not archived")
+
+	flag.StringVar(&config.Sentinel, "sentinel", "", "Write a JSON completion marker to this path once the backup succeeded, removing any old one at the start")
+	flag.StringVar(&config.Report, "report", "", "Write an HTML summary of the run to this path, e.g. backup-report.html")
+	flag.BoolVar(&config.VerifyByRestore, "verify-by-restore", false, "After the backup, restore it into a scratch directory, start it and run SELECT 1")
+	addTestRestoreFlags(flag.CommandLine, &config.TestRestore)
+	ui.AddColorFlag(flag.CommandLine)
+	ui.AddStrictFlag(flag.CommandLine)
 
 	flag.Parse()
 
+	if err := applyService(flag.CommandLine, config); err != nil {
+		log.Fatal(err)
+	}
+	config.TestRestore.User = config.User
+
+	if err := config.Validate(); err != nil {
+		flag.Usage()
+		log.Fatal("Error: invalid configuration:\n" + err.Error())
+	}
+
+	// Resolve vault:// and awssm:// references
+	password, err := resolveSecret(config.Password)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config.Password = password
+
 	// Set PGPASSWORD environment variable if password is provided
 	if config.Password != "" {
 		os.Setenv("PGPASSWORD", config.Password)
@@ -73,80 +248,406 @@ func parseFlags() *Config {
 	return config
 }
 
-func run(config *Config) error {
+func run(config *Config) (err error) {
 	printMsg(colorGreen, "PostgreSQL Cluster Backup (pg_basebackup)")
 	fmt.Println(strings.Repeat("=", 50))
+	timeline := report.NewTimeline()
+
+	// The report covers failed runs too
+	outcome := sentinel.Success
+	var summary *backupSummary
+	defer func() {
+		writeReport(config, timeline, outcome, summary, err)
+	}()
+
+	// A marker from an earlier run must not pass for this one
+	if config.Sentinel != "" {
+		if err := sentinel.Clear(config.Sentinel); err != nil {
+			return err
+		}
+	}
 
 	// Test connection and check replication permission
-	if err := testConnection(config); err != nil {
+	clock, err := testConnection(config)
+	if err != nil {
 		return fmt.Errorf("connection test failed: %w", err)
 	}
 
-	// Estimate database size
-	size, err := estimateSize(config)
-	if err != nil {
-		printMsg(colorYellow, "Warning: Could not estimate database size: "+err.Error())
+	// Skip the backup entirely if the cluster has been idle
+	if config.SkipIfUnchanged {
+		unchanged, err := checkUnchanged(config)
+		if err != nil {
+			return fmt.Errorf("failed to check for changes: %w", err)
+		}
+		if unchanged {
+			outcome = sentinel.Skipped
+			return writeSentinel(config, outcome, nil)
+		}
+	}
+	timeline.Mark("Connection checks")
+
+	// Estimate the backup size and check that it fits
+	var size int64
+	if config.ParallelEstimate {
+		if estimate, err := estimateDetailed(config); err == nil {
+			printEstimate(estimate)
+			size = estimate.Total()
+		} else {
+			warn("Could not estimate backup size: " + err.Error())
+		}
+	} else if estimated, err := estimateSize(config); err != nil {
+		warn("Could not estimate database size: " + err.Error())
 	} else {
-		printMsg(colorBlue, fmt.Sprintf("Estimated database size: %s", formatBytes(size)))
+		printMsg(colorBlue, fmt.Sprintf("Estimated database size: %s", formatBytes(estimated)))
+		size = estimated
 	}
+	if size > 0 {
+		if err := checkFreeSpace(config, size); err != nil {
+			return err
+		}
+	}
+	timeline.Mark("Size estimate")
 
-	// Create backup
-	backupPath, err := createBackup(config)
+	// Create, verify and record the backup
+	result, err := createBackup(config, clock, timeline)
 	if err != nil {
 		return fmt.Errorf("backup failed: %w", err)
 	}
+	summary = newBackupSummary(config, result, size)
 
-	// Verify backup
-	if err := verifyBackup(config, backupPath); err != nil {
-		return fmt.Errorf("backup verification failed: %w", err)
+	printMsg(colorGreen, "\n✓ Backup completed successfully!")
+	if size > 0 && result.Size > 0 {
+		printMsg("", fmt.Sprintf("Size: %s (%.0f%% of the %s estimate)", formatBytes(result.Size), 100*float64(result.Size)/float64(size), formatBytes(size)))
+	}
+	if result.Archive != "" {
+		printMsg("", fmt.Sprintf("Location: %s", result.Archive))
+	} else {
+		printMsg("", fmt.Sprintf("Location: %s", result.Path))
 	}
 
-	printMsg(colorGreen, "\n✓ Backup completed successfully!")
-	printMsg("", fmt.Sprintf("Location: %s", backupPath))
+	if result.Label != nil {
+		fmt.Println("Backup label:")
+		result.Label.Print(os.Stdout, "  ")
+	}
 
-	return nil
-}
+	// Prove the backup restores and starts
+	if config.VerifyByRestore && !config.DryRun {
+		printMsg(colorGreen, "\nTest restore")
+		location := result.Path
+		if result.Archive != "" {
+			location = result.Archive
+		}
+		if err := testRestore(location, &config.TestRestore); err != nil {
+			return fmt.Errorf("backup %s was created but failed the test restore: %w", location, err)
+		}
+		timeline.Mark("Test restore")
+		summary.TestRestored = true
+	}
 
-func testConnection(config *Config) error {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		config.Host, config.Port, config.User, config.Password, config.Database)
+	return writeSentinel(config, outcome, summary.timed(timeline))
+}
 
-	db, err := sql.Open("postgres", connStr)
+// testConnection checks that the server can be backed up and compares its
+// clock with the local one, which the manifest records.
+func testConnection(config *Config) (*manifest.Clock, error) {
+	db, err := sql.Open("postgres", connString(config))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer db.Close()
 
-	// Test connection
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := db.PingContext(ctx); err != nil {
-		return err
+	// Test connection, riding out a short failover if asked to
+	if err := pingWithRetry(config, db); err != nil {
+		return nil, describeConnectError(config, err)
 	}
 
 	// Check replication permission
 	var hasReplication bool
 	err = db.QueryRow("SELECT rolreplication FROM pg_roles WHERE rolname = $1", config.User).Scan(&hasReplication)
 	if err != nil {
-		return fmt.Errorf("failed to check replication permission: %w", err)
+		return nil, fmt.Errorf("failed to check replication permission: %w", err)
 	}
 
 	if !hasReplication {
-		return fmt.Errorf("user '%s' does not have REPLICATION permission", config.User)
+		return nil, fmt.Errorf("user '%s' does not have REPLICATION permission", config.User)
+	}
+
+	// pg_basebackup needs a replication connection, which the server only
+	// accepts above wal_level=minimal
+	var walLevel string
+	if err := db.QueryRow("SHOW wal_level").Scan(&walLevel); err != nil {
+		return nil, fmt.Errorf("failed to check wal_level: %w", err)
+	}
+	if walLevel == "minimal" {
+		return nil, fmt.Errorf("server has wal_level = minimal, which cannot stream WAL for a base backup; " +
+			"set wal_level to replica or logical (and max_wal_senders above 0) and restart the server")
 	}
 
 	printMsg(colorGreen, fmt.Sprintf("✓ Connected to %s:%d as %s", config.Host, config.Port, config.User))
 	printMsg(colorGreen, "✓ User has REPLICATION permission")
+	printMsg(colorGreen, fmt.Sprintf("✓ wal_level is %s", walLevel))
+
+	clock, err := checkClock(config, db)
+	if err != nil {
+		warn("Could not compare clocks: " + err.Error())
+	}
+
+	if config.LockTimeout > 0 {
+		reportLongTransactions(config, db)
+	}
+
+	return clock, nil
+}
+
+func connString(config *Config) string {
+	return connStringDB(config, config.Database)
+}
+
+func connStringDB(config *Config, database string) string {
+	conn := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		config.Host, config.Port, config.User, config.Password, database, config.SSLMode)
+	if option := lockTimeoutOption(config); option != "" {
+		conn += fmt.Sprintf(" options='%s'", option)
+	}
+	return conn
+}
+
+// showSetting returns the current value of a server setting.
+func showSetting(config *Config, name string) (string, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var value string
+	if err := db.QueryRow("SELECT current_setting($1)", name).Scan(&value); err != nil {
+		return "", err
+	}
+	return value, nil
+}
+
+// serverMajorVersion returns the major version of the server in the form
+// PG_VERSION uses ("16").
+func serverMajorVersion(config *Config) (string, error) {
+	value, err := showSetting(config, "server_version_num")
+	if err != nil {
+		return "", err
+	}
+	num, err := strconv.Atoi(value)
+	if err != nil {
+		return "", fmt.Errorf("unexpected server_version_num %q", value)
+	}
+	if num < 100000 {
+		// Before PostgreSQL 10 the major version has two parts ("9.6")
+		return fmt.Sprintf("%d.%d", num/10000, num/100%100), nil
+	}
+	return strconv.Itoa(num / 10000), nil
+}
+
+// walSegmentSize returns the cluster's WAL segment size in bytes.
+func walSegmentSize(config *Config) (int64, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	// pg_settings reports wal_segment_size in bytes
+	var size int64
+	err = db.QueryRow("SELECT setting::bigint FROM pg_settings WHERE name = 'wal_segment_size'").Scan(&size)
+	return size, err
+}
+
+// systemIdentifier returns the database system identifier of the cluster.
+func systemIdentifier(config *Config) (string, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	var id string
+	err = db.QueryRow("SELECT system_identifier::text FROM pg_control_system()").Scan(&id)
+	return id, err
+}
+
+// collectExtensions lists the extensions installed in every database that
+// accepts connections, so restore can check the target binaries provide them.
+func collectExtensions(config *Config) ([]manifest.Extension, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT datname FROM pg_database WHERE datallowconn AND NOT datistemplate ORDER BY datname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var databases []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		databases = append(databases, name)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var extensions []manifest.Extension
+	for _, database := range databases {
+		found, err := databaseExtensions(config, database)
+		if err != nil {
+			return nil, fmt.Errorf("database %s: %w", database, err)
+		}
+		extensions = append(extensions, found...)
+	}
+	return extensions, nil
+}
+
+func databaseExtensions(config *Config, database string) ([]manifest.Extension, error) {
+	db, err := sql.Open("postgres", connStringDB(config, database))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT extname, extversion FROM pg_extension ORDER BY extname")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var extensions []manifest.Extension
+	for rows.Next() {
+		ext := manifest.Extension{Database: database}
+		if err := rows.Scan(&ext.Name, &ext.Version); err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, ext)
+	}
+	return extensions, rows.Err()
+}
+
+// collectTablespaces lists the cluster's own tablespaces with their current
+// locations. pg_default and pg_global live in the data directory.
+func collectTablespaces(config *Config) ([]manifest.Tablespace, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT oid, spcname, pg_tablespace_location(oid) FROM pg_tablespace
+		WHERE spcname NOT IN ('pg_default', 'pg_global') ORDER BY oid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tablespaces []manifest.Tablespace
+	for rows.Next() {
+		var ts manifest.Tablespace
+		if err := rows.Scan(&ts.OID, &ts.Name, &ts.Location); err != nil {
+			return nil, err
+		}
+		tablespaces = append(tablespaces, ts)
+	}
+	return tablespaces, rows.Err()
+}
+
+// checkTablespaceArchives makes sure a tar-format backup has an archive for
+// every tablespace, as pg_basebackup writes one <oid>.tar per tablespace.
+func checkTablespaceArchives(m *manifest.Manifest) error {
+	for _, ts := range m.Tablespaces {
+		prefix := fmt.Sprintf("%d.tar", ts.OID)
+		found := false
+		for _, f := range m.Files {
+			if strings.HasPrefix(f.Name, prefix) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("no archive for tablespace %s (%d.tar) in the backup", ts.Name, ts.OID)
+		}
+	}
 	return nil
 }
 
-func estimateSize(config *Config) (int64, error) {
-	connStr := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
-		config.Host, config.Port, config.User, config.Password, config.Database)
+// checkUnchanged compares the cluster's current WAL position with the stop
+// LSN of the latest backup and reports whether the new backup can be skipped.
+func checkUnchanged(config *Config) (bool, error) {
+	last, lastDir, err := manifest.Latest(backupRoot(config))
+	if err != nil {
+		if os.IsNotExist(err) {
+			printMsg(colorYellow, "No previous backup with a manifest found, creating a full backup")
+			return false, nil
+		}
+		return false, err
+	}
 
-	db, err := sql.Open("postgres", connStr)
+	if last.StopLSN == "" {
+		printMsg(colorYellow, fmt.Sprintf("Previous backup %s has no recorded stop LSN, creating a new backup", lastDir))
+		return false, nil
+	}
+
+	// The LSNs only compare within one cluster, and a backup directory may
+	// be shared by several
+	if last.SystemIdentifier == "" {
+		printMsg(colorYellow, fmt.Sprintf("Previous backup %s has no recorded system identifier, creating a new backup", lastDir))
+		return false, nil
+	}
+	current, err := systemIdentifier(config)
+	if err != nil {
+		return false, err
+	}
+	if current != last.SystemIdentifier {
+		printMsg(colorYellow, fmt.Sprintf("Previous backup %s is of another cluster (system identifier %s, this one is %s), creating a new backup",
+			lastDir, last.SystemIdentifier, current))
+		return false, nil
+	}
+
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	// A standby that has not replayed anything yet has no replay LSN
+	var currentLSN sql.NullString
+	var walBytes sql.NullInt64
+	err = db.QueryRow(`
+		SELECT lsn::text, pg_wal_lsn_diff(lsn, $1::pg_lsn)::bigint
+		FROM (SELECT CASE WHEN pg_is_in_recovery()
+			THEN pg_last_wal_replay_lsn()
+			ELSE pg_current_wal_lsn() END AS lsn) AS current
+	`, last.StopLSN).Scan(&currentLSN, &walBytes)
+	if err != nil {
+		return false, err
+	}
+
+	if !currentLSN.Valid || !walBytes.Valid {
+		printMsg(colorYellow, "The server reports no current WAL position, creating a new backup")
+		return false, nil
+	}
+	if walBytes.Int64 > config.SkipThreshold {
+		printMsg(colorBlue, fmt.Sprintf("%s of WAL written since %s, creating a new backup", formatBytes(walBytes.Int64), filepath.Base(lastDir)))
+		return false, nil
+	}
+
+	printMsg(colorGreen, fmt.Sprintf("✓ Skipping backup: only %s of WAL written since %s (stop LSN %s, current LSN %s, threshold %s)",
+		formatBytes(max(walBytes.Int64, 0)), filepath.Base(lastDir), last.StopLSN, currentLSN.String, formatBytes(config.SkipThreshold)))
+	return true, nil
+}
+
+func estimateSize(config *Config) (int64, error) {
+	db, err := sql.Open("postgres", connString(config))
 	if err != nil {
 		return 0, err
 	}
@@ -170,21 +671,295 @@ func estimateSize(config *Config) (int64, error) {
 	return size.Int64, nil
 }
 
-func createBackup(config *Config) (string, error) {
+// createBackup runs pg_basebackup, post-processes and verifies the result and
+// writes its manifest. Any failure after the backup directory was created is
+// handled in one place according to --on-failure.
+func createBackup(config *Config, clock *manifest.Clock, timeline *report.Timeline) (result *BackupResult, err error) {
 	// Create timestamped backup directory
-	timestamp := time.Now().Format("20060102_150405")
-	backupName := fmt.Sprintf("cluster_backup_%s", timestamp)
-	backupPath := filepath.Join(config.BackupDir, backupName)
+	finalPath := config.OutputDir
+	if finalPath == "" {
+		timestamp := time.Now().Format("20060102_150405")
+		backupName := fmt.Sprintf("cluster_backup_%s", timestamp)
+		finalPath = filepath.Join(config.BackupDir, backupName)
+	}
+
+	// The backup is written under a hidden temporary name and only renamed
+	// to its final name once it is verified and recorded, so anything
+	// watching the backup directory never sees a half-finished backup.
+	backupPath := tempPath(finalPath)
+	result = &BackupResult{Path: backupPath, Clock: clock}
+
+	// Never mix backups or write a backup into the cluster it is copying
+	if err := checkBackupLocation(config, finalPath); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(backupPath); err == nil {
+		return nil, fmt.Errorf("temporary backup directory %s already exists, remove it if no other backup is running", backupPath)
+	}
 
 	if config.DryRun {
-		printMsg(colorYellow, "DRY RUN: Would create backup in "+backupPath)
-		return backupPath, nil
+		printMsg(colorYellow, "DRY RUN: Would create backup in "+finalPath)
+	} else {
+		// Create backup directory
+		if err := os.MkdirAll(backupPath, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create backup directory: %w", err)
+		}
+
+		defer func() {
+			if err != nil {
+				handleFailure(config, backupPath, finalPath)
+			}
+		}()
+
+		if err = runBaseBackup(config, result); err != nil {
+			return nil, err
+		}
+		timeline.Mark("pg_basebackup")
+	}
+
+	// Drop excluded paths from the backup
+	if err = applyExcludes(config, backupPath); err != nil {
+		return nil, fmt.Errorf("failed to apply exclusions: %w", err)
+	}
+
+	// Verify backup
+	if config.NoVerify {
+		warn("Skipping backup verification (--no-verify)")
+	} else {
+		if err = verifyBackup(config, backupPath); err != nil {
+			return nil, fmt.Errorf("backup verification failed: %w", err)
+		}
+		result.Verified = true
+		timeline.Mark("Verification")
+	}
+
+	// Pick up the recovery metadata pg_basebackup recorded
+	if !config.DryRun {
+		if result.Label, err = readBackupLabel(config, backupPath); err != nil {
+			warn("Could not read backup_label: " + err.Error())
+			err = nil
+		}
+	}
+
+	// Keep the streamed WAL for point-in-time recovery past this backup
+	if config.WALArchiveDir != "" {
+		if err = archiveWAL(config, result); err != nil {
+			return nil, fmt.Errorf("failed to archive WAL: %w", err)
+		}
+		timeline.Mark("WAL archive")
+	}
+
+	// Keep roles and tablespaces for logical restores
+	if config.DumpGlobals {
+		if err = dumpGlobals(config, backupPath); err != nil {
+			return nil, fmt.Errorf("failed to dump globals: %w", err)
+		}
+		timeline.Mark("Globals")
+	}
+
+	// Cut oversized tar files into volumes
+	if result.Volumes, err = splitVolumes(config, backupPath); err != nil {
+		return nil, err
+	}
+
+	// Record backup metadata
+	if err = writeManifest(config, result); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// The runbook names the backup where it ends up
+	if config.Runbook {
+		location := finalPath
+		if config.ArchiveTar {
+			location += backupfs.ArchiveSuffix
+		}
+		if config.DryRun {
+			printMsg(colorYellow, "DRY RUN: Would write "+manifest.RunbookFileName)
+		} else if err = writeRunbookFor(backupPath, location); err != nil {
+			return nil, err
+		}
+	}
+
+	timeline.Mark("Manifest")
+
+	// With --strict, a backup that drew warnings is discarded instead of
+	// published
+	if err = ui.StrictError(); err != nil {
+		return nil, err
+	}
+
+	// Package everything into a single archive, or publish the directory
+	if config.ArchiveTar {
+		if result.Archive, err = createArchive(config, backupPath, finalPath); err != nil {
+			return nil, fmt.Errorf("failed to create archive: %w", err)
+		}
+		timeline.Mark("Archive")
+	} else if !config.DryRun {
+		if err = os.Rename(backupPath, finalPath); err != nil {
+			return nil, fmt.Errorf("failed to move backup into place: %w", err)
+		}
+	}
+	result.Path = finalPath
+
+	// Let --skip-if-unchanged find it, archive or not
+	if !config.DryRun {
+		location := finalPath
+		if result.Archive != "" {
+			location = result.Archive
+		}
+		if err := manifest.RecordLatest(filepath.Dir(finalPath), location, result.Manifest); err != nil {
+			warn("Could not record the backup as the latest one: " + err.Error())
+		}
+	}
+
+	return result, nil
+}
+
+// backupRoot is the directory backups are written into: --backup-dir, or
+// the parent of --output-dir.
+func backupRoot(config *Config) string {
+	if config.OutputDir != "" {
+		return filepath.Dir(config.OutputDir)
+	}
+	return config.BackupDir
+}
+
+// tempPath returns the hidden name a backup is written under before it is
+// moved to path: .<name>.tmp in the same directory, so the final rename never
+// crosses file systems.
+func tempPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+}
+
+// checkBackupLocation refuses a backup directory that already has content
+// and one that lies inside the server's data directory, which would make the
+// backup include itself.
+func checkBackupLocation(config *Config, backupPath string) error {
+	entries, err := os.ReadDir(backupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check backup directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("backup directory %s already exists and is not empty", backupPath)
+	}
+
+	if config.ArchiveTar {
+		if _, err := os.Stat(backupPath + backupfs.ArchiveSuffix); err == nil {
+			return fmt.Errorf("backup archive %s already exists", backupPath+backupfs.ArchiveSuffix)
+		}
+	}
+
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var dataDir string
+	if err := db.QueryRow("SHOW data_directory").Scan(&dataDir); err != nil {
+		// Requires superuser or pg_read_all_settings
+		warn("Could not read the server's data_directory, skipping location check: " + err.Error())
+		return nil
+	}
+
+	// Symlinks are followed where the paths can be resolved on this host
+	inside := backupfs.Within(dataDir, backupPath)
+	if realDataDir, err := backupfs.Resolve(dataDir); err == nil {
+		if realBackup, err := backupfs.Resolve(backupPath); err == nil {
+			inside = backupfs.Within(realDataDir, realBackup)
+		}
+	}
+	if inside {
+		return fmt.Errorf("backup directory %s is inside the PostgreSQL data directory %s", backupPath, dataDir)
+	}
+
+	return nil
+}
+
+// handleFailure applies the --on-failure policy to a backup that did not
+// complete and reports exactly what was left behind or removed.
+func handleFailure(config *Config, backupPath, finalPath string) {
+	if config.OnFailure == "keep" {
+		printMsg(colorYellow, "\nBackup failed, keeping partial backup for inspection: "+backupPath)
+		return
+	}
+
+	printMsg(colorYellow, "\nBackup failed, cleaning up...")
+
+	if err := os.RemoveAll(backupPath); err != nil {
+		printMsg(colorRed, fmt.Sprintf("Failed to remove partial backup %s: %v", backupPath, err))
+	} else {
+		printMsg(colorYellow, "Removed partial backup directory: "+backupPath)
+	}
+
+	archivePath := tempPath(finalPath + backupfs.ArchiveSuffix)
+	if _, err := os.Stat(archivePath); err == nil {
+		if err := os.Remove(archivePath); err != nil {
+			printMsg(colorRed, fmt.Sprintf("Failed to remove partial archive %s: %v", archivePath, err))
+		} else {
+			printMsg(colorYellow, "Removed partial archive: "+archivePath)
+		}
+	}
+
+	slots, err := dropLeftoverSlots(config)
+	if err != nil {
+		printMsg(colorRed, "Could not check for leftover replication slots: "+err.Error())
+		return
+	}
+	if len(slots) == 0 {
+		printMsg(colorYellow, "No leftover replication slots found")
+	}
+	for _, slot := range slots {
+		printMsg(colorYellow, "Dropped leftover temporary replication slot: "+slot)
+	}
+}
+
+// dropLeftoverSlots drops inactive temporary slots created by pg_basebackup.
+// The server normally releases them when the WAL stream disconnects, but one
+// can linger briefly after an aborted backup.
+func dropLeftoverSlots(config *Config) ([]string, error) {
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+		SELECT slot_name FROM pg_replication_slots
+		WHERE temporary AND NOT active AND slot_name LIKE 'pg\_basebackup\_%'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var slots []string
+	for rows.Next() {
+		var slot string
+		if err := rows.Scan(&slot); err != nil {
+			return nil, err
+		}
+		slots = append(slots, slot)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
 
-	// Create backup directory
-	if err := os.MkdirAll(backupPath, 0755); err != nil {
-		return "", fmt.Errorf("failed to create backup directory: %w", err)
+	var dropped []string
+	for _, slot := range slots {
+		if _, err := db.Exec("SELECT pg_drop_replication_slot($1)", slot); err != nil {
+			printMsg(colorRed, fmt.Sprintf("Failed to drop replication slot %s: %v", slot, err))
+			continue
+		}
+		dropped = append(dropped, slot)
 	}
+	return dropped, nil
+}
+
+// runBaseBackup runs pg_basebackup into result.Path and records the WAL
+// positions it reports.
+func runBaseBackup(config *Config, result *BackupResult) error {
+	backupPath := result.Path
 
 	printMsg(colorBlue, fmt.Sprintf("\nStarting backup to: %s", backupPath))
 
@@ -215,55 +990,246 @@ func createBackup(config *Config) (string, error) {
 
 	// Create command
 	cmd := exec.Command("pg_basebackup", args...)
+	appName := fmt.Sprintf("save_%d", os.Getpid())
+	cmd.Env = baseBackupEnv(config, appName)
 	
 	// Capture output for progress
 	if !config.NoProgress {
 		stderr, err := cmd.StderrPipe()
 		if err != nil {
-			return "", err
+			return err
 		}
 
 		// Start command
 		if err := cmd.Start(); err != nil {
-			return "", err
+			return err
 		}
+		stalled := watchBackupStart(config, appName, cmd.Process)
 
-		// Monitor progress
+		// Monitor progress. pg_basebackup redraws its progress line with
+		// carriage returns, so split on those as well as on newlines.
 		scanner := bufio.NewScanner(stderr)
+		scanner.Split(scanLinesOrCR)
 		progressRe := regexp.MustCompile(`(\d+)/(\d+)\s+kB\s+\((\d+)%\)`)
-		
+
+		// Keep the most recent non-progress lines for the error message
+		var tail []string
+
 		for scanner.Scan() {
 			line := scanner.Text()
+			result.parseLine(line)
+			if strings.TrimSpace(line) != "" && !progressRe.MatchString(line) {
+				tail = append(tail, line)
+				if len(tail) > stderrTailLines {
+					tail = tail[1:]
+				}
+			}
 			if matches := progressRe.FindStringSubmatch(line); matches != nil {
 				current, _ := strconv.ParseInt(matches[1], 10, 64)
 				total, _ := strconv.ParseInt(matches[2], 10, 64)
 				percent := matches[3]
 				
-				fmt.Printf("\r%sProgress: %s%% (%s / %s)%s",
-					colorBlue,
+				fmt.Print("\r" + ui.Colorize(colorBlue, fmt.Sprintf("Progress: %s%% (%s / %s)",
 					percent,
 					formatBytes(current*1024),
-					formatBytes(total*1024),
-					colorReset)
+					formatBytes(total*1024))))
 			}
 		}
 		fmt.Println() // New line after progress
 
 		// Wait for completion
-		if err := cmd.Wait(); err != nil {
-			return "", fmt.Errorf("pg_basebackup failed: %w", err)
+		err = cmd.Wait()
+		if reason := stalled(); reason != nil {
+			return fmt.Errorf("pg_basebackup stopped: %w", reason)
+		}
+		if err != nil {
+			return baseBackupError(config, err, strings.Join(tail, "\n"))
 		}
 	} else {
 		// Run without progress monitoring
-		output, err := cmd.CombinedOutput()
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		stalled := watchBackupStart(config, appName, cmd.Process)
+		err := cmd.Wait()
+		if reason := stalled(); reason != nil {
+			return fmt.Errorf("pg_basebackup stopped: %w", reason)
+		}
 		if err != nil {
-			return "", fmt.Errorf("pg_basebackup failed: %w\nOutput: %s", err, output)
+			return baseBackupError(config, err, output.String())
+		}
+		for _, line := range strings.Split(output.String(), "\n") {
+			result.parseLine(line)
 		}
 	}
 
-	return backupPath, nil
+	return nil
+}
+
+// stderrTailLines is how many non-progress stderr lines of pg_basebackup are
+// kept for reporting a failure.
+const stderrTailLines = 50
+
+// scanLinesOrCR is a bufio.SplitFunc that ends a token at "\n" or "\r".
+func scanLinesOrCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+var (
+	startLSNRe = regexp.MustCompile(`write-ahead log start point: ([0-9A-F]+/[0-9A-F]+) on timeline (\d+)`)
+	stopLSNRe  = regexp.MustCompile(`write-ahead log end point: ([0-9A-F]+/[0-9A-F]+)`)
+)
+
+// parseLine picks the WAL positions out of pg_basebackup's verbose output.
+func (r *BackupResult) parseLine(line string) {
+	if matches := startLSNRe.FindStringSubmatch(line); matches != nil {
+		r.StartLSN = matches[1]
+		r.Timeline, _ = strconv.Atoi(matches[2])
+	}
+	if matches := stopLSNRe.FindStringSubmatch(line); matches != nil {
+		r.StopLSN = matches[1]
+	}
+}
+
+// readBackupLabel parses the backup_label pg_basebackup wrote, either as a
+// file in a plain backup or as a member of base.tar[.gz].
+func readBackupLabel(config *Config, backupPath string) (*backuplabel.Label, error) {
+	if config.Format != "tar" {
+		return backuplabel.ReadFile(filepath.Join(backupPath, backuplabel.FileName))
+	}
+
+	tarFiles, _ := filepath.Glob(filepath.Join(backupPath, "base.tar*"))
+	if len(tarFiles) == 0 {
+		return nil, fmt.Errorf("base.tar not found")
+	}
+
+	file, err := os.Open(tarFiles[0])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if !strings.HasSuffix(tarFiles[0], ".gz") {
+		return backuplabel.FromTar(file)
+	}
+
+	gzReader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %w", err)
+	}
+	defer gzReader.Close()
+
+	return backuplabel.FromTar(gzReader)
 }
 
+// writeManifest records the backup's metadata and file checksums.
+func writeManifest(config *Config, result *BackupResult) error {
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would write "+manifest.FileName)
+		return nil
+	}
+
+	m := manifest.New()
+	m.Host = config.Host
+	m.Port = config.Port
+	m.Format = config.Format
+	m.Compress = config.Compress
+	m.StartLSN = result.StartLSN
+	m.StopLSN = result.StopLSN
+	m.Timeline = result.Timeline
+	m.BackupLabel = result.Label
+	m.Verified = result.Verified
+	m.Volumes = result.Volumes
+	m.Clock = result.Clock
+	if config.DumpGlobals {
+		m.Globals = manifest.GlobalsFileName
+	}
+	if config.WALArchiveDir != "" {
+		m.WALArchive, _ = filepath.Abs(config.WALArchiveDir)
+	}
+
+	extensions, err := collectExtensions(config)
+	if err != nil {
+		warn("Could not record installed extensions: " + err.Error())
+	}
+	m.Extensions = extensions
+
+	if m.Tablespaces, err = collectTablespaces(config); err != nil {
+		warn("Could not record tablespace locations: " + err.Error())
+	}
+
+	if m.DataChecksums, err = showSetting(config, "data_checksums"); err != nil {
+		warn("Could not record data_checksums: " + err.Error())
+	}
+	if m.WALSegmentSize, err = walSegmentSize(config); err != nil {
+		warn("Could not record wal_segment_size: " + err.Error())
+	}
+	if m.PGVersion, err = serverMajorVersion(config); err != nil {
+		warn("Could not record the server version: " + err.Error())
+	}
+	if m.SystemIdentifier, err = systemIdentifier(config); err != nil {
+		warn("Could not record the system identifier: " + err.Error())
+	}
+
+	if config.RecordSourceSettings {
+		if m.Settings, err = collectSettings(config); err != nil {
+			warn("Could not record the source's settings: " + err.Error())
+		} else if config.RecommendedConf {
+			if err := writeRecommendedConf(config, result.Path, m.Settings); err != nil {
+				return fmt.Errorf("failed to write %s: %w", manifest.SettingsFileName, err)
+			}
+		}
+	}
+
+	if err := m.CollectFiles(result.Path); err != nil {
+		return err
+	}
+	result.Size = m.Size
+	result.PGVersion = m.PGVersion
+	for _, ext := range m.Extensions {
+		if ext.Name == "timescaledb" {
+			result.TimescaleDB = ext.Version
+		}
+	}
+	if m.Format == "tar" {
+		if err := checkTablespaceArchives(m); err != nil {
+			return err
+		}
+	}
+	if err := m.WriteChecksums(result.Path); err != nil {
+		return err
+	}
+	if err := m.Write(result.Path); err != nil {
+		return err
+	}
+	result.Manifest = m
+
+	printMsg(colorGreen, fmt.Sprintf("✓ Wrote %s and %s", manifest.FileName, manifest.ChecksumsFileName))
+
+	if config.RedactManifest {
+		if err := writeRedactedManifest(m, config.RedactFields, config.RedactHash, filepath.Join(result.Path, manifest.RedactedFileName)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tablespaceArchive matches the archives pg_basebackup -Ft writes for
+// tablespaces other than pg_default and pg_global.
+var tablespaceArchive = regexp.MustCompile(`^\d+\.tar(\.gz)?$`)
+
 func verifyBackup(config *Config, backupPath string) error {
 	if config.DryRun {
 		printMsg(colorYellow, "DRY RUN: Would verify backup")
@@ -295,6 +1261,21 @@ func verifyBackup(config *Config, backupPath string) error {
 				return fmt.Errorf("expected file not found: %s", file)
 			}
 		}
+
+		// Every other tablespace is in an archive named after its OID
+		entries, err := os.ReadDir(backupPath)
+		if err != nil {
+			return fmt.Errorf("failed to read backup directory: %w", err)
+		}
+		var tablespaces []string
+		for _, entry := range entries {
+			if tablespaceArchive.MatchString(entry.Name()) {
+				tablespaces = append(tablespaces, entry.Name())
+			}
+		}
+		if len(tablespaces) > 0 {
+			printMsg(colorGreen, "✓ Tablespace archives: "+strings.Join(tablespaces, ", "))
+		}
 	}
 
 	// Calculate backup size
@@ -332,11 +1313,13 @@ func formatBytes(bytes int64) string {
 }
 
 func printMsg(color, msg string) {
-	if color != "" {
-		fmt.Printf("%s%s%s\n", color, msg, colorReset)
-	} else {
-		fmt.Println(msg)
-	}
+	ui.Println(color, msg)
+}
+
+// warn reports something the operator should look at. --strict turns it
+// into an error (see ui.StrictError).
+func warn(msg string) {
+	ui.Warn(msg)
 }
 
 func getEnv(key, defaultVal string) string {
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// runPrune implements `save prune`, which applies a retention policy to the
+// backup directory. It only reports what it would do unless --delete is given.
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	backupDir := fs.String("backup-dir", "backups", "Backup directory")
+	retentionCount := fs.Int("retention-count", 0, "Keep the N most recent backups")
+	retentionDays := fs.Int("retention-days", 0, "Keep backups younger than N days")
+	removePartial := fs.Bool("remove-partial", false, "Also delete partial backups left by failed or aborted runs")
+	del := fs.Bool("delete", false, "Actually delete (default is a dry run)")
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Parse(args)
+
+	if *retentionCount <= 0 && *retentionDays <= 0 && !*removePartial {
+		fs.Usage()
+		return fmt.Errorf("prune needs --retention-count, --retention-days and/or --remove-partial")
+	}
+
+	printMsg(colorGreen, "PostgreSQL Backup Retention")
+	fmt.Println(strings.Repeat("=", 50))
+	if !*del {
+		printMsg(colorYellow, "DRY RUN MODE - Nothing will be deleted (use --delete)")
+	}
+
+	backups, err := scanRepository(*backupDir)
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %w", *backupDir, err)
+	}
+
+	// Partial backups never count towards retention
+	var complete, partial []*repoBackup
+	for _, b := range backups {
+		if b.Status == statusPartial {
+			partial = append(partial, b)
+		} else {
+			complete = append(complete, b)
+		}
+	}
+
+	var keep, remove []*repoBackup
+	if *retentionCount > 0 || *retentionDays > 0 {
+		keep, remove = applyRetention(complete, *retentionCount, *retentionDays)
+	} else {
+		keep = complete
+	}
+
+	if len(partial) > 0 {
+		fmt.Println("\n" + ui.Colorize(colorBold, "Partial backups:"))
+		for _, b := range partial {
+			note := ""
+			switch {
+			case b.Active():
+				note = " (skipped)"
+			case *removePartial:
+				remove = append(remove, b)
+			}
+			fmt.Printf("  %-40s size %-10s %s%s\n", b.Name, formatBytes(b.Size), b.Problem, note)
+		}
+		if !*removePartial {
+			printMsg(colorYellow, "Use --remove-partial to delete them")
+		}
+	}
+
+	var reclaimed int64
+	if len(remove) == 0 {
+		printMsg(colorGreen, "\nNo backups to delete")
+	} else {
+		fmt.Println("\n" + ui.Colorize(colorBold, "Backups to delete:"))
+		for _, b := range remove {
+			reclaimed += b.Size
+			fmt.Printf("  %-40s age %-9s size %-10s cumulative %s\n", b.Name, formatAge(b.Age()), formatBytes(b.Size), formatBytes(reclaimed))
+		}
+	}
+
+	fmt.Println("\n" + ui.Colorize(colorBold, "Backups kept:"))
+	for _, b := range keep {
+		fmt.Printf("  %-40s age %-9s size %s\n", b.Name, formatAge(b.Age()), formatBytes(b.Size))
+	}
+
+	if !*del {
+		printMsg(colorBlue, fmt.Sprintf("\nWould delete %d backups and reclaim %s", len(remove), formatBytes(reclaimed)))
+		return nil
+	}
+
+	for _, b := range remove {
+		if err := os.RemoveAll(b.Path); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", b.Path, err)
+		}
+		printMsg(colorYellow, "Deleted "+b.Path)
+	}
+	printMsg(colorGreen, fmt.Sprintf("\n✓ Deleted %d backups, reclaimed %s", len(remove), formatBytes(reclaimed)))
+	return nil
+}
+
+// applyRetention splits backups (newest first) into those to keep and those
+// to delete. A backup is kept if it is among the count most recent or
+// younger than days; the newest backup is always kept.
+func applyRetention(backups []*repoBackup, count, days int) (keep, remove []*repoBackup) {
+	cutoff := time.Now().AddDate(0, 0, -days)
+
+	for i, b := range backups {
+		kept := i == 0 ||
+			(count > 0 && i < count) ||
+			(days > 0 && b.Created.After(cutoff))
+		if kept {
+			keep = append(keep, b)
+		} else {
+			remove = append(remove, b)
+		}
+	}
+	return keep, remove
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// runRedact implements `save redact`, which writes a copy of a backup's
+// manifest without the fields that describe the source, for handing the
+// backup to someone outside. manifest.json itself is left alone.
+func runRedact(args []string) error {
+	fs := flag.NewFlagSet("redact", flag.ExitOnError)
+	var fields stringList
+	fs.Var(&fields, "field", "Manifest field to redact instead of the defaults, e.g. extensions.database (repeatable)")
+	hash := fs.Bool("hash", false, "Replace redacted strings with a hash of their value instead of removing them")
+	output := fs.String("output", "", "Where to write the redacted manifest (default: "+manifest.RedactedFileName+" in the backup)")
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: save redact [options] <backup-dir>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("redact needs exactly one backup directory")
+	}
+	dir := fs.Arg(0)
+
+	m, err := manifest.Read(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	path := *output
+	if path == "" {
+		path = filepath.Join(dir, manifest.RedactedFileName)
+	}
+	return writeRedactedManifest(m, fields, *hash, path)
+}
+
+// writeRedactedManifest writes m to path without the given fields, or
+// without manifest.DefaultRedactFields when none are given.
+func writeRedactedManifest(m *manifest.Manifest, fields []string, hash bool, path string) error {
+	if len(fields) == 0 {
+		fields = manifest.DefaultRedactFields
+	}
+
+	data, err := m.Redact(fields, hash)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write redacted manifest: %w", err)
+	}
+
+	action := "removed"
+	if hash {
+		action = "hashed"
+	}
+	printMsg(colorGreen, fmt.Sprintf("✓ Wrote %s (%s: %s)", path, action, strings.Join(fields, ", ")))
+	return nil
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/backuplabel"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// defaultGzipLevel is recorded for gzip files whose level cannot be told.
+const defaultGzipLevel = 6
+
+// volumePart matches the name of a numbered volume of a tar file under any
+// of backupfs.TarSuffixes, such as base.tar.gz.001 or base.tar.zst.002.
+var volumePart = regexp.MustCompile(`^(.+(?:` + volumeSuffixes() + `))\.(\d{3})$`)
+
+func volumeSuffixes() string {
+	quoted := make([]string, len(backupfs.TarSuffixes))
+	for i, suffix := range backupfs.TarSuffixes {
+		quoted[i] = regexp.QuoteMeta(suffix)
+	}
+	return strings.Join(quoted, "|")
+}
+
+// runReindex implements `save reindex`, which writes manifest.json and
+// SHA256SUMS for backups made before the save tool recorded them. Everything
+// is inferred from the backup itself; its data files are only read.
+func runReindex(args []string) error {
+	fs := flag.NewFlagSet("reindex", flag.ExitOnError)
+	force := fs.Bool("force", false, "Replace an existing manifest")
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: save reindex [--force] <backup-dir>...\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("reindex needs at least one backup directory")
+	}
+
+	printMsg(colorGreen, "PostgreSQL Backup Reindex")
+	fmt.Println(strings.Repeat("=", 50))
+
+	failed := 0
+	for _, dir := range fs.Args() {
+		fmt.Println("\n" + ui.Colorize(colorBold, dir))
+		if err := reindexBackup(dir, *force); err != nil {
+			printMsg(colorRed, "  ✗ "+err.Error())
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d backups could not be reindexed", failed, fs.NArg())
+	}
+	return nil
+}
+
+// reindexBackup writes the manifest for the backup in dir.
+func reindexBackup(dir string, force bool) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a backup directory (archives carry the manifest inside)")
+	}
+	if !force && fileExists(filepath.Join(dir, manifest.FileName)) {
+		printMsg(colorYellow, "  Already has "+manifest.FileName+", skipping (use --force to replace it)")
+		return nil
+	}
+
+	m := manifest.New()
+	m.Reindexed = true
+	m.CreatedAt = time.Time{}
+
+	switch {
+	case fileExists(filepath.Join(dir, "PG_VERSION")):
+		m.Format = "plain"
+		if err := inspectPlainBackup(dir, m); err != nil {
+			return err
+		}
+	case findTar(dir, "base") != "":
+		m.Format = "tar"
+		if err := inspectTarBackup(dir, m); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("no plain or tar backup found")
+	}
+
+	if m.BackupLabel != nil {
+		m.StartLSN = m.BackupLabel.StartWALLocation
+		m.Timeline = m.BackupLabel.StartTimeline
+		if t, ok := labelTime(m.BackupLabel.StartTime); ok {
+			m.CreatedAt = t
+		}
+	}
+	if stop := stopLSNFromBackupManifest(dir); stop != "" {
+		m.StopLSN = stop
+	}
+	if m.CreatedAt.IsZero() {
+		m.CreatedAt = reindexTime(dir, info)
+	}
+
+	if err := m.CollectFiles(dir); err != nil {
+		return err
+	}
+	if err := m.WriteChecksums(dir); err != nil {
+		return err
+	}
+	if err := m.Write(dir); err != nil {
+		return err
+	}
+
+	printMsg(colorGreen, fmt.Sprintf("  ✓ Wrote %s and %s (%s backup, %d files, %s)",
+		manifest.FileName, manifest.ChecksumsFileName, m.Format, len(m.Files), formatBytes(m.Size)))
+	return nil
+}
+
+// inspectPlainBackup fills in what a plain backup's data directory records.
+func inspectPlainBackup(dir string, m *manifest.Manifest) error {
+	version, err := os.ReadFile(filepath.Join(dir, "PG_VERSION"))
+	if err != nil {
+		return err
+	}
+	m.PGVersion = strings.TrimSpace(string(version))
+
+	label, err := backuplabel.ReadFile(filepath.Join(dir, backuplabel.FileName))
+	if err != nil {
+		warn("  No readable backup_label: " + err.Error())
+	}
+	m.BackupLabel = label
+
+	printMsg(colorBlue, fmt.Sprintf("  Plain backup of PostgreSQL %s", m.PGVersion))
+	return nil
+}
+
+// inspectTarBackup infers compression and volumes from the file names and
+// reads PG_VERSION and backup_label out of base.tar.
+func inspectTarBackup(dir string, m *manifest.Manifest) error {
+	baseTar := findTar(dir, "base")
+	m.Compress = 0
+	compression := "uncompressed"
+	switch {
+	case strings.HasSuffix(baseTar, ".gz"):
+		m.Compress = gzipLevel(baseTar)
+		compression = "gzip"
+	case strings.HasSuffix(baseTar, ".zst"):
+		m.Compression = "zstd"
+		compression = m.Compression
+	case strings.HasSuffix(baseTar, ".lz4"):
+		m.Compression = "lz4"
+		compression = m.Compression
+	}
+
+	volumes, err := findVolumes(dir)
+	if err != nil {
+		return err
+	}
+	m.Volumes = volumes
+
+	members, err := readTarMembers(baseTar, "PG_VERSION", backuplabel.FileName)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", filepath.Base(baseTar), err)
+	}
+	if data, ok := members["PG_VERSION"]; ok {
+		m.PGVersion = strings.TrimSpace(string(data))
+	} else {
+		warn("  PG_VERSION not found in " + filepath.Base(baseTar))
+	}
+	if data, ok := members[backuplabel.FileName]; ok {
+		if m.BackupLabel, err = backuplabel.Parse(strings.NewReader(string(data))); err != nil {
+			warn("  Invalid backup_label: " + err.Error())
+		}
+	} else {
+		warn("  backup_label not found in " + filepath.Base(baseTar))
+	}
+
+	printMsg(colorBlue, fmt.Sprintf("  Tar backup (%s) of PostgreSQL %s", compression, m.PGVersion))
+	return nil
+}
+
+// gzipLevel guesses the compression level of a gzip file. The header only
+// says whether the fastest or the best compression was used; anything else
+// is recorded as the default level. Restores only care whether a backup is
+// compressed at all.
+func gzipLevel(path string) int {
+	f, err := backupfs.OpenVolumes(path)
+	if err != nil {
+		return defaultGzipLevel
+	}
+	defer f.Close()
+
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return defaultGzipLevel
+	}
+	switch header[8] {
+	case 2:
+		return gzip.BestCompression
+	case 4:
+		return gzip.BestSpeed
+	}
+	return defaultGzipLevel
+}
+
+// findVolumes describes the tar files in dir that are split into volumes.
+func findVolumes(dir string) ([]manifest.Volume, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]*manifest.Volume{}
+	for _, entry := range entries {
+		match := volumePart.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		v, ok := byName[match[1]]
+		if !ok {
+			v = &manifest.Volume{Name: match[1]}
+			byName[match[1]] = v
+		}
+		v.Parts++
+		v.Size += info.Size()
+	}
+
+	var volumes []manifest.Volume
+	for _, v := range byName {
+		for n := 1; n <= v.Parts; n++ {
+			if !fileExists(filepath.Join(dir, manifest.VolumeName(v.Name, n))) {
+				return nil, fmt.Errorf("volumes of %s are not numbered 1 to %d", v.Name, v.Parts)
+			}
+		}
+		volumes = append(volumes, *v)
+	}
+	sort.Slice(volumes, func(i, j int) bool { return volumes[i].Name < volumes[j].Name })
+	return volumes, nil
+}
+
+// readTarMembers returns the contents of the named top-level files of a
+// possibly compressed or split tar, stopping as soon as all are found.
+func readTarMembers(tarFile string, names ...string) (map[string][]byte, error) {
+	file, err := backupfs.OpenVolumes(tarFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	r, err := decompress(tarFile, file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	wanted := map[string]bool{}
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	found := map[string][]byte{}
+	tarReader := tar.NewReader(r)
+	for len(found) < len(wanted) {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimPrefix(header.Name, "./")
+		if !wanted[name] || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(tarReader, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+		found[name] = data
+	}
+	return found, nil
+}
+
+// stopLSNFromBackupManifest reads the end of the backup's WAL range from the
+// backup_manifest pg_basebackup writes (PostgreSQL 13 and later).
+func stopLSNFromBackupManifest(dir string) string {
+	data, err := os.ReadFile(filepath.Join(dir, "backup_manifest"))
+	if err != nil {
+		return ""
+	}
+
+	var bm struct {
+		WALRanges []struct {
+			EndLSN string `json:"End-LSN"`
+		} `json:"WAL-Ranges"`
+	}
+	if err := json.Unmarshal(data, &bm); err != nil || len(bm.WALRanges) == 0 {
+		return ""
+	}
+	return bm.WALRanges[len(bm.WALRanges)-1].EndLSN
+}
+
+// labelTime parses a backup_label START TIME. Go only knows the offset of a
+// few zone abbreviations and silently assumes UTC for the others, so only
+// those are trusted.
+func labelTime(value string) (time.Time, bool) {
+	t, err := time.Parse("2006-01-02 15:04:05 MST", value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if zone, offset := t.Zone(); offset == 0 && zone != "UTC" && zone != "GMT" {
+		return time.Time{}, false
+	}
+	return t.UTC(), true
+}
+
+// reindexTime falls back to the timestamp in the directory name, then to
+// its modification time.
+func reindexTime(dir string, info os.FileInfo) time.Time {
+	stamp := strings.TrimPrefix(filepath.Base(filepath.Clean(dir)), manifest.BackupPrefix)
+	if t, err := time.ParseInLocation("20060102_150405", stamp, time.Local); err == nil {
+		return t.UTC()
+	}
+	return info.ModTime().UTC()
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/report"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// writeReport writes the --report page for the run, whether it succeeded or
+// not; summary is nil when it failed before there was a backup. A report
+// that cannot be written is reported but does not change the outcome.
+func writeReport(config *Config, timeline *report.Timeline, outcome string, summary *backupSummary, runErr error) {
+	if config.Report == "" {
+		return
+	}
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would write report "+config.Report)
+		return
+	}
+	if runErr == nil {
+		runErr = ui.StrictError()
+	}
+
+	r := &report.Report{
+		Tool:       "save",
+		Outcome:    outcome,
+		StartedAt:  timeline.Start,
+		FinishedAt: time.Now(),
+		Source: []report.Field{
+			{Label: "Server", Value: fmt.Sprintf("%s:%d", config.Host, config.Port)},
+			{Label: "User", Value: config.User},
+		},
+	}
+	if runErr != nil {
+		r.Outcome = report.Failed
+		r.Error = runErr.Error()
+	}
+
+	if summary = summary.timed(timeline); summary != nil {
+		r.Summary = backupReportFields(config, summary)
+		if summary.PGVersion != "" {
+			r.Source = append(r.Source, report.Field{Label: "PostgreSQL", Value: summary.PGVersion})
+		}
+		if summary.TimescaleDB != "" {
+			r.Source = append(r.Source, report.Field{Label: "TimescaleDB", Value: summary.TimescaleDB})
+		}
+	}
+	r.Phases = timeline.Phases()
+
+	if err := report.Write(config.Report, r); err != nil {
+		warn(err.Error())
+		return
+	}
+	printMsg(colorGreen, "✓ Wrote report "+config.Report)
+}
+
+// backupReportFields lists what the report shows about the backup.
+func backupReportFields(config *Config, s *backupSummary) []report.Field {
+	format := s.Format
+	if s.Format == "tar" && config.Compress > 0 {
+		format = fmt.Sprintf("tar, gzip level %d", config.Compress)
+	}
+	if config.ArchiveTar {
+		format += ", packaged into a zstd archive"
+	}
+
+	fields := []report.Field{
+		{Label: "Backup", Value: s.Backup},
+		{Label: "Format", Value: format},
+		{Label: "Size", Value: formatBytes(s.Size)},
+	}
+	if s.Estimate > 0 {
+		fields = append(fields, report.Field{Label: "Estimated size", Value: formatBytes(s.Estimate)})
+	}
+	duration := time.Duration(s.Seconds * float64(time.Second))
+	fields = append(fields, report.Field{Label: "Duration", Value: duration.String()})
+	if s.Seconds > 0 {
+		fields = append(fields, report.Field{Label: "Throughput", Value: formatBytes(int64(float64(s.Size)/s.Seconds)) + "/s"})
+	}
+
+	verified := "no (--no-verify)"
+	if s.Verified {
+		verified = "yes, the expected files are present"
+	}
+	fields = append(fields, report.Field{Label: "Verified", Value: verified})
+	testRestored := "not run"
+	if s.TestRestored {
+		testRestored = "restored, started and queried"
+	}
+	fields = append(fields, report.Field{Label: "Test restore", Value: testRestored})
+
+	if s.StartLSN != "" {
+		fields = append(fields, report.Field{Label: "WAL", Value: fmt.Sprintf("%s to %s on timeline %d", s.StartLSN, s.StopLSN, s.Timeline)})
+	}
+	return fields
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// Backup states reported by scanRepository.
+const (
+	statusComplete = "complete"
+	statusPartial  = "partial"
+	statusUnknown  = "unknown"
+)
+
+// activeWindow is how recently a temporary backup must have been written to
+// be treated as still running rather than aborted.
+const activeWindow = 15 * time.Minute
+
+// repoBackup is a backup found in the backup directory, either a
+// cluster_backup_<timestamp> directory or a .tar.zst archive of one, or the
+// hidden .tmp directory or archive of one that never finished.
+type repoBackup struct {
+	Name     string
+	Path     string
+	Created  time.Time
+	Modified time.Time
+	Size     int64
+	Archive  bool
+	Temp     bool
+	Manifest *manifest.Manifest
+
+	// Status is complete, partial or unknown; Problem says what is wrong
+	// with a partial backup or why one is unknown.
+	Status  string
+	Problem string
+}
+
+// Age returns how long ago the backup was created.
+func (b *repoBackup) Age() time.Duration {
+	return time.Since(b.Created)
+}
+
+// Active reports whether b is a temporary backup that is probably still
+// being written.
+func (b *repoBackup) Active() bool {
+	return b.Temp && time.Since(b.Modified) < activeWindow
+}
+
+// scanRepository lists the backups under root, newest first, and classifies
+// each of them.
+func scanRepository(root string) ([]*repoBackup, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []*repoBackup
+	for _, entry := range entries {
+		name := entry.Name()
+		temp := strings.HasPrefix(name, "."+manifest.BackupPrefix) && strings.HasSuffix(name, ".tmp")
+		if !strings.HasPrefix(name, manifest.BackupPrefix) && !temp {
+			continue
+		}
+
+		path := filepath.Join(root, name)
+		b := &repoBackup{Name: name, Path: path, Temp: temp}
+		base := strings.TrimSuffix(strings.TrimPrefix(name, "."), ".tmp")
+
+		switch {
+		case entry.IsDir():
+			b.Manifest, _ = manifest.Read(path)
+			b.Size, b.Modified, _ = dirSize(path)
+		case strings.HasSuffix(base, backupfs.ArchiveSuffix):
+			b.Archive = true
+			if info, err := entry.Info(); err == nil {
+				b.Size = info.Size()
+				b.Modified = info.ModTime()
+			}
+		default:
+			continue
+		}
+
+		b.Created = backupTime(b, base, entry)
+		b.Status, b.Problem = classifyBackup(b)
+		backups = append(backups, b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Created.After(backups[j].Created) })
+	return backups, nil
+}
+
+// classifyBackup decides whether b is complete, partial or unknown with a
+// quick structural check that does not read the backup data: the files
+// listed in a manifest must all be present with the recorded size, and an
+// archive must start with the zstd magic number. Backups without a manifest
+// (made before it existed) are unknown unless they hold no backup at all.
+func classifyBackup(b *repoBackup) (status, problem string) {
+	if b.Temp {
+		if b.Active() {
+			return statusPartial, "unfinished, probably still being written"
+		}
+		return statusPartial, "unfinished (left over from an aborted run)"
+	}
+
+	if b.Archive {
+		if !hasZstdMagic(b.Path) {
+			return statusPartial, "not a zstd archive"
+		}
+		return statusComplete, ""
+	}
+
+	if b.Manifest == nil {
+		if _, err := os.Stat(filepath.Join(b.Path, manifest.FileName)); err == nil {
+			return statusPartial, "unreadable " + manifest.FileName
+		}
+		if findTar(b.Path, "base") != "" || fileExists(filepath.Join(b.Path, "PG_VERSION")) {
+			return statusUnknown, "no " + manifest.FileName
+		}
+		return statusPartial, "no backup data"
+	}
+
+	if err := b.Manifest.CheckFiles(b.Path); err != nil {
+		return statusPartial, err.Error()
+	}
+	return statusComplete, ""
+}
+
+// hasZstdMagic reports whether the file at path starts a zstd frame.
+func hasZstdMagic(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd})
+}
+
+// backupTime determines when a backup was taken: from its manifest, else from
+// the timestamp in its name, else from the modification time.
+func backupTime(b *repoBackup, name string, entry os.DirEntry) time.Time {
+	if b.Manifest != nil && !b.Manifest.CreatedAt.IsZero() {
+		return b.Manifest.CreatedAt
+	}
+
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, manifest.BackupPrefix), backupfs.ArchiveSuffix)
+	if t, err := time.ParseInLocation("20060102_150405", stamp, time.Local); err == nil {
+		return t
+	}
+
+	if info, err := entry.Info(); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// dirSize returns the total size of the files under path and the latest
+// modification time among them.
+func dirSize(path string) (int64, time.Time, error) {
+	var total int64
+	var latest time.Time
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return total, latest, err
+}
+
+// formatAge renders a duration as days and hours.
+func formatAge(d time.Duration) string {
+	hours := int(d.Hours())
+	if hours >= 24 {
+		return fmt.Sprintf("%dd %dh", hours/24, hours%24)
+	}
+	return fmt.Sprintf("%dh", hours)
+}
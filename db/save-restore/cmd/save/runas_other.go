@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// runAs is only implemented on Unix; elsewhere serverCredential never
+// returns a user to switch to.
+func runAs(cmd *exec.Cmd, u *serverUser) {}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// runAs makes cmd run as u, or as the current user when u is nil.
+func runAs(cmd *exec.Cmd, u *serverUser) {
+	if u == nil {
+		return
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uint32(u.UID), Gid: uint32(u.GID)},
+	}
+}
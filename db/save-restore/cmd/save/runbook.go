@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// defaultRestoreDataDir is the restore tool's default --data-dir.
+const defaultRestoreDataDir = "/var/lib/postgresql/data"
+
+// runRunbook implements `save runbook`, which writes RESTORE.md into an
+// existing backup, e.g. one taken before --runbook existed.
+func runRunbook(args []string) error {
+	fs := flag.NewFlagSet("runbook", flag.ExitOnError)
+	output := fs.String("output", "", "Where to write the runbook (default: "+manifest.RunbookFileName+" in the backup)")
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: save runbook [options] <backup-dir>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("runbook needs exactly one backup directory")
+	}
+	dir := fs.Arg(0)
+
+	m, err := manifest.Read(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	location, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	path := *output
+	if path == "" {
+		path = filepath.Join(dir, manifest.RunbookFileName)
+	}
+	return writeRunbook(m, location, path)
+}
+
+// writeRunbookFor writes RESTORE.md into the backup in dir from its
+// manifest, for save --runbook.
+func writeRunbookFor(dir, location string) error {
+	m, err := manifest.Read(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if location, err = filepath.Abs(location); err != nil {
+		return err
+	}
+	return writeRunbook(m, location, filepath.Join(dir, manifest.RunbookFileName))
+}
+
+// writeRunbook writes the restore runbook for the backup described by m to
+// path. location is where the backup will be found, the directory or the
+// .tar.zst archive, and is what the commands pass to --backup.
+func writeRunbook(m *manifest.Manifest, location, path string) error {
+	if err := os.WriteFile(path, []byte(runbook(m, location)), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", manifest.RunbookFileName, err)
+	}
+	printMsg(colorGreen, "✓ Wrote "+path)
+	return nil
+}
+
+// runbook renders RESTORE.md: what the backup is, what the target needs and
+// the restore commands for exactly this backup.
+func runbook(m *manifest.Manifest, location string) string {
+	var b strings.Builder
+	line := func(format string, args ...any) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+	name := strings.TrimSuffix(filepath.Base(location), backupfs.ArchiveSuffix)
+
+	line("# Restoring %s", name)
+	line("")
+	line("Generated by `save` from the backup's `%s`. The commands below restore", manifest.FileName)
+	line("exactly this backup; read them through before running any.")
+	line("")
+
+	line("## The Backup")
+	line("")
+	line("| | |")
+	line("|---|---|")
+	line("| Created | %s |", m.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	if m.Host != "" {
+		line("| Source | %s:%d |", m.Host, m.Port)
+	}
+	line("| Format | %s |", describeFormat(m, location))
+	line("| Size | %s |", formatBytes(m.Size))
+	if m.PGVersion != "" {
+		line("| PostgreSQL | %s |", m.PGVersion)
+	}
+	for _, ext := range m.Extensions {
+		if ext.Name == "timescaledb" {
+			line("| TimescaleDB | %s |", ext.Version)
+			break
+		}
+	}
+	if m.WALSegmentSize > 0 {
+		line("| WAL segment size | %s |", formatBytes(m.WALSegmentSize))
+	}
+	if m.DataChecksums != "" {
+		line("| Data checksums | %s |", m.DataChecksums)
+	}
+	if m.StartLSN != "" {
+		line("| WAL | %s to %s on timeline %d |", m.StartLSN, m.StopLSN, m.Timeline)
+	}
+	line("| Verified | %t |", m.Verified)
+	line("")
+
+	line("## Before You Start")
+	line("")
+	if m.PGVersion != "" {
+		line("- The target must run PostgreSQL %s; restore compares it with `pg_config`", m.PGVersion)
+	}
+	for _, ext := range m.Extensions {
+		if ext.Name == "timescaledb" {
+			line("- TimescaleDB %s must be installed on the target", ext.Version)
+			break
+		}
+	}
+	line("- Stop the PostgreSQL server using the data directory; restore replaces its contents")
+	line("- The data directory needs at least %s free, plus room for the WAL replayed on startup", formatBytes(m.Size))
+	if strings.HasSuffix(location, backupfs.ArchiveSuffix) {
+		line("- The archive is unpacked next to it or under `--staging-dir DIR` first, which needs about %s more", formatBytes(m.Size))
+	}
+	for _, v := range m.Volumes {
+		line("- `%s` is split into %d parts (`%s` to `%s`); keep all of them together, restore joins them",
+			v.Name, v.Parts, manifest.VolumeName(v.Name, 1), manifest.VolumeName(v.Name, v.Parts))
+	}
+	if len(m.Tablespaces) > 0 {
+		line("- The tablespaces are restored to the locations below; change a `--tablespace-map` if that path is not free on the target")
+	}
+	line("- The backup is not encrypted; decompression is done by restore")
+	line("")
+
+	if len(m.Tablespaces) > 0 {
+		line("| Tablespace | OID | Original location |")
+		line("|---|---|---|")
+		for _, ts := range m.Tablespaces {
+			line("| %s | %d | %s |", ts.Name, ts.OID, ts.Location)
+		}
+		line("")
+	}
+
+	var options []string
+	for _, ts := range m.Tablespaces {
+		options = append(options, fmt.Sprintf("--tablespace-map %s", shellQuote(fmt.Sprintf("%d=%s", ts.OID, ts.Location))))
+	}
+	command := func(extra ...string) {
+		args := append([]string{`./restore --backup "$BACKUP" --data-dir "$DATA_DIR"`}, options...)
+		line("%s", strings.Join(append(args, extra...), " \\\n    "))
+	}
+
+	line("## Restore")
+	line("")
+	line("Set where the backup and the data directory are, if they moved:")
+	line("")
+	line("```bash")
+	line("BACKUP=%s", shellQuote(location))
+	line("DATA_DIR=%s", defaultRestoreDataDir)
+	line("```")
+	line("")
+	if !strings.HasSuffix(location, backupfs.ArchiveSuffix) {
+		line("Check the files against their checksums:")
+		line("")
+		line("```bash")
+		line(`(cd "$BACKUP" && sha256sum -c %s)`, manifest.ChecksumsFileName)
+		line("```")
+		line("")
+	}
+	line("See what would happen, without changing anything:")
+	line("")
+	line("```bash")
+	command("--dry-run")
+	line("```")
+	line("")
+	line("Restore, after a confirmation prompt:")
+	line("")
+	line("```bash")
+	command()
+	line("```")
+	line("")
+
+	if m.Globals != "" {
+		line("## Roles for a Logical Restore")
+		line("")
+		line("`%s` holds the source's roles and tablespaces. Before loading a logical", m.Globals)
+		line("dump into another server, create them there (psql connection settings")
+		line("such as `PGPASSWORD` apply):")
+		line("")
+		line("```bash")
+		line(`./restore --backup "$BACKUP" --restore-globals --host TARGET_HOST --user postgres`)
+		line("```")
+		line("")
+	}
+
+	line("## Point-in-Time Recovery")
+	line("")
+	if m.WALArchive != "" {
+		line("The WAL of this backup was archived to `%s`. To recover to a point after", m.WALArchive)
+		line("the backup, give a target and the archive as the restored server sees it:")
+		line("")
+		line("```bash")
+		command("--recovery-target-time 'YYYY-MM-DD HH:MM:SS+00'", "--wal-archive-dir "+shellQuote(m.WALArchive))
+		line("```")
+	} else {
+		line("No WAL archive was recorded for this backup. Recovery to a later point")
+		line("needs one; with a retrieval command of your own:")
+		line("")
+		line("```bash")
+		command("--recovery-target-time 'YYYY-MM-DD HH:MM:SS+00'", "--restore-command '/path/to/wal-fetch %f %p'")
+		line("```")
+	}
+	line("")
+	line("Do not run `pg_resetwal` on a cluster restored for point-in-time recovery.")
+	return b.String()
+}
+
+// describeFormat names the backup's format and compression for the runbook.
+func describeFormat(m *manifest.Manifest, location string) string {
+	format := "plain (a copy of the data directory)"
+	if m.Format == "tar" {
+		format = "tar"
+		if m.Compress > 0 {
+			format = fmt.Sprintf("tar, gzip level %d", m.Compress)
+		} else if m.Compression != "" {
+			format = "tar, " + m.Compression
+		}
+	}
+	if strings.HasSuffix(location, backupfs.ArchiveSuffix) {
+		format += ", packaged into a zstd archive"
+	}
+	if len(m.Volumes) > 0 {
+		format += ", split into volumes"
+	}
+	return format
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
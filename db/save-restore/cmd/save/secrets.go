@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Secret references let credentials come from a secrets manager instead of
+// the command line or environment:
+//
+//	vault://<path>#<field>   HashiCorp Vault KV secret, via the vault CLI
+//	awssm://<name>[#<field>] AWS Secrets Manager secret, via the aws CLI;
+//	                         with a field the secret string is read as JSON
+//
+// The CLIs use their usual configuration (VAULT_ADDR, VAULT_TOKEN, AWS
+// profile or instance role). Resolved values are cached for the run and never
+// printed.
+var secretCache = map[string]string{}
+
+// isSecretRef reports whether value is a secret reference.
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, "vault://") || strings.HasPrefix(value, "awssm://")
+}
+
+// resolveSecret returns value itself, or the secret it refers to.
+func resolveSecret(value string) (string, error) {
+	if !isSecretRef(value) {
+		return value, nil
+	}
+	if secret, ok := secretCache[value]; ok {
+		return secret, nil
+	}
+
+	scheme, name, field, err := parseSecretRef(value)
+	if err != nil {
+		return "", err
+	}
+
+	var secret string
+	switch scheme {
+	case "vault":
+		secret, err = runSecretCommand("vault", "kv", "get", "-field="+field, name)
+	case "awssm":
+		secret, err = runSecretCommand("aws", "secretsmanager", "get-secret-value",
+			"--secret-id", name, "--query", "SecretString", "--output", "text")
+		if err == nil && field != "" {
+			secret, err = jsonField(secret, field)
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch secret %s: %w", redactRef(value), err)
+	}
+
+	secret = strings.TrimRight(secret, "\n")
+	if secret == "" {
+		return "", fmt.Errorf("secret %s is empty", redactRef(value))
+	}
+
+	secretCache[value] = secret
+	return secret, nil
+}
+
+// parseSecretRef splits a secret reference into its scheme, secret name and
+// field.
+func parseSecretRef(value string) (scheme, name, field string, err error) {
+	scheme, rest, _ := strings.Cut(value, "://")
+	name, field, _ = strings.Cut(rest, "#")
+	if name == "" {
+		return "", "", "", fmt.Errorf("invalid secret reference %s: missing secret name", redactRef(value))
+	}
+	if scheme == "vault" && field == "" {
+		return "", "", "", fmt.Errorf("invalid secret reference %s: vault references need a #field", redactRef(value))
+	}
+	return scheme, name, field, nil
+}
+
+func runSecretCommand(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s: %w: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+func jsonField(secret, field string) (string, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object, cannot read field %q", field)
+	}
+
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("secret has no field %q", field)
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	return fmt.Sprint(value), nil
+}
+
+// redactRef returns a secret reference for messages. References only name
+// secrets, but are passed through here so a mistyped literal password given
+// with a secret scheme is never echoed in full.
+func redactRef(value string) string {
+	scheme, rest, _ := strings.Cut(value, "://")
+	name, _, _ := strings.Cut(rest, "#")
+	return scheme + "://" + name
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/report"
+	"github.com/timescaledb-tools/save-restore/internal/sentinel"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// backupSummary is what the --sentinel marker records about a backup. The
+// --report page is rendered from it too.
+type backupSummary struct {
+	Backup       string         `json:"backup,omitempty"`
+	Format       string         `json:"format"`
+	Size         int64          `json:"size,omitempty"`
+	Estimate     int64          `json:"estimated_size,omitempty"`
+	StartLSN     string         `json:"start_lsn,omitempty"`
+	StopLSN      string         `json:"stop_lsn,omitempty"`
+	Timeline     int            `json:"timeline,omitempty"`
+	Verified     bool           `json:"verified"`
+	TestRestored bool           `json:"test_restored,omitempty"`
+	Source       string         `json:"source"`
+	PGVersion    string         `json:"pg_version,omitempty"`
+	TimescaleDB  string         `json:"timescaledb_version,omitempty"`
+	Seconds      float64        `json:"duration_seconds"`
+	Phases       []report.Phase `json:"phases,omitempty"`
+}
+
+// newBackupSummary summarizes result, a backup estimated at estimate bytes.
+func newBackupSummary(config *Config, result *BackupResult, estimate int64) *backupSummary {
+	summary := &backupSummary{
+		Backup:      result.Path,
+		Format:      config.Format,
+		Size:        result.Size,
+		Estimate:    estimate,
+		StartLSN:    result.StartLSN,
+		StopLSN:     result.StopLSN,
+		Timeline:    result.Timeline,
+		Verified:    result.Verified,
+		Source:      fmt.Sprintf("%s:%d", config.Host, config.Port),
+		PGVersion:   result.PGVersion,
+		TimescaleDB: result.TimescaleDB,
+	}
+	if result.Archive != "" {
+		summary.Backup = result.Archive
+	}
+	return summary
+}
+
+// timed records the duration and phases of the run so far in s.
+func (s *backupSummary) timed(timeline *report.Timeline) *backupSummary {
+	if s == nil {
+		return nil
+	}
+	s.Seconds = time.Since(timeline.Start).Round(time.Millisecond).Seconds()
+	s.Phases = timeline.Phases()
+	return s
+}
+
+// writeSentinel writes the --sentinel marker once the run has succeeded;
+// with --strict, warnings so far fail the run instead. A marker that cannot
+// be written is reported but does not fail the backup that was made.
+func writeSentinel(config *Config, outcome string, summary any) error {
+	if config.Sentinel == "" {
+		return nil
+	}
+	if err := ui.StrictError(); err != nil {
+		return err
+	}
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would write sentinel "+config.Sentinel)
+		return nil
+	}
+	if err := sentinel.Write(config.Sentinel, "save", outcome, summary); err != nil {
+		warn(err.Error())
+		return nil
+	}
+	printMsg(colorGreen, "✓ Wrote sentinel "+config.Sentinel)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/timescaledb-tools/save-restore/internal/pgservice"
+)
+
+// defaultSSLMode is the sslmode of save's own connections without a
+// service defining one.
+const defaultSSLMode = "disable"
+
+// envService and envServiceFile are PGSERVICE and PGSERVICEFILE as save was
+// started with. lib/pq does not support services and panics when either is
+// set, so takeServiceEnv removes them before any subcommand runs; --service
+// defaults to envService and serviceEnv hands them back to child processes.
+var envService, envServiceFile string
+
+// takeServiceEnv moves PGSERVICE and PGSERVICEFILE from the environment into
+// envService and envServiceFile.
+func takeServiceEnv() {
+	envService = os.Getenv("PGSERVICE")
+	envServiceFile = os.Getenv("PGSERVICEFILE")
+	os.Unsetenv("PGSERVICE")
+	os.Unsetenv("PGSERVICEFILE")
+}
+
+// addServiceFlag registers --service on fs.
+func addServiceFlag(fs *flag.FlagSet, config *Config) {
+	fs.StringVar(&config.Service, "service", envService, "Connection service in pg_service.conf to take host, port, user, database and sslmode from; explicit flags override it")
+}
+
+// applyService fills in the connection settings of --service that were not
+// given as flags on the parsed fs, after which the service wins over the
+// PG* environment variables as it does in libpq.
+func applyService(fs *flag.FlagSet, config *Config) error {
+	config.SSLMode = defaultSSLMode
+	config.ServiceFile = envServiceFile
+	if config.Service == "" {
+		return nil
+	}
+
+	settings, path, err := pgservice.Lookup(config.Service, config.ServiceFile)
+	if err != nil {
+		return err
+	}
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for key, field := range map[string]*string{
+		"host":     &config.Host,
+		"user":     &config.User,
+		"password": &config.Password,
+		"database": &config.Database,
+	} {
+		name := key
+		if key == "database" {
+			name = "dbname"
+		}
+		if value, ok := settings[name]; ok && !explicit[key] {
+			*field = value
+		}
+	}
+	if value, ok := settings["port"]; ok && !explicit["port"] {
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("service %q in %s has an invalid port %q", config.Service, path, value)
+		}
+		config.Port = port
+	}
+	if value, ok := settings["sslmode"]; ok {
+		config.SSLMode = value
+	}
+
+	printMsg(colorBlue, fmt.Sprintf("Using service %s from %s", config.Service, path))
+	return nil
+}
+
+// serviceEnv returns the variables that give child processes such as
+// pg_basebackup the same service as save's own connections, for the
+// settings save does not pass as options, like sslmode.
+func serviceEnv(config *Config) []string {
+	if config.Service == "" {
+		return nil
+	}
+	env := []string{"PGSERVICE=" + config.Service}
+	if config.ServiceFile != "" {
+		env = append(env, "PGSERVICEFILE="+config.ServiceFile)
+	}
+	return env
+}
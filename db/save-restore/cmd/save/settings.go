@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// defaultSourceSettings are the settings --record-source-settings records
+// unless --source-setting is given: the ones a rebuilt cluster most often
+// has to match. A restored cluster in recovery refuses to start when
+// max_connections, max_worker_processes, max_wal_senders,
+// max_prepared_transactions or max_locks_per_transaction are lower than
+// on the source.
+var defaultSourceSettings = []string{
+	"shared_buffers",
+	"effective_cache_size",
+	"work_mem",
+	"maintenance_work_mem",
+	"max_connections",
+	"max_worker_processes",
+	"max_parallel_workers",
+	"max_wal_senders",
+	"max_replication_slots",
+	"max_prepared_transactions",
+	"max_locks_per_transaction",
+	"wal_level",
+	"max_wal_size",
+	"min_wal_size",
+	"shared_preload_libraries",
+	"timezone",
+	"timescaledb.*",
+}
+
+// collectSettings returns the current value of every server setting that
+// matches one of the --source-setting patterns (or the defaults), in the
+// form SHOW prints it.
+func collectSettings(config *Config) (map[string]string, error) {
+	patterns := []string(config.SourceSettings)
+	if len(patterns) == 0 {
+		patterns = defaultSourceSettings
+	}
+
+	db, err := sql.Open("postgres", connString(config))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT name, current_setting(name) FROM pg_settings")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+				settings[name] = value
+				break
+			}
+		}
+	}
+	return settings, rows.Err()
+}
+
+// writeRecommendedConf writes the recorded settings as a postgresql.conf
+// snippet next to the backup for the operator to apply to a rebuilt cluster.
+func writeRecommendedConf(config *Config, dir string, settings map[string]string) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Settings of %s:%d at the time of the backup (%s).\n",
+		config.Host, config.Port, time.Now().UTC().Format(time.RFC3339))
+	fmt.Fprintf(&b, "# Copy what applies to the rebuilt cluster into its postgresql.conf.\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s = '%s'\n", name, strings.ReplaceAll(settings[name], "'", "''"))
+	}
+
+	return os.WriteFile(filepath.Join(dir, manifest.SettingsFileName), []byte(b.String()), 0644)
+}
+
+// validateSourceSettings checks the --source-setting patterns.
+func validateSourceSettings(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			return fmt.Errorf("invalid --source-setting %q", pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// splitVolumes replaces every tar file in a tar-format backup that is larger
+// than --split-size with numbered volumes of at most that size, for storage
+// with a per-object size limit. The restore tool joins them back together.
+func splitVolumes(config *Config, backupPath string) ([]manifest.Volume, error) {
+	if config.SplitSize <= 0 {
+		return nil, nil
+	}
+
+	if config.DryRun {
+		printMsg(colorYellow, fmt.Sprintf("DRY RUN: Would split tar files larger than %s into volumes", formatBytes(config.SplitSize)))
+		return nil, nil
+	}
+
+	tarFiles, err := filepath.Glob(filepath.Join(backupPath, "*.tar*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []manifest.Volume
+	for _, tarFile := range tarFiles {
+		info, err := os.Stat(tarFile)
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() || info.Size() <= config.SplitSize {
+			continue
+		}
+
+		parts, err := splitFile(tarFile, config.SplitSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split %s: %w", filepath.Base(tarFile), err)
+		}
+		printMsg(colorGreen, fmt.Sprintf("✓ Split %s (%s) into %d volumes", filepath.Base(tarFile), formatBytes(info.Size()), parts))
+
+		volumes = append(volumes, manifest.Volume{Name: filepath.Base(tarFile), Parts: parts, Size: info.Size()})
+	}
+	return volumes, nil
+}
+
+// splitFile writes path into path.001, path.002, ... of at most size bytes
+// each and removes path once every volume is written.
+func splitFile(path string, size int64) (int, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	var written []string
+	cleanup := func() {
+		for _, name := range written {
+			os.Remove(name)
+		}
+	}
+
+	for n := 1; ; n++ {
+		name := manifest.VolumeName(path, n)
+		out, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err != nil {
+			cleanup()
+			return 0, err
+		}
+		written = append(written, name)
+
+		copied, err := io.CopyN(out, in, size)
+		if closeErr := out.Close(); closeErr != nil && (err == nil || err == io.EOF) {
+			err = closeErr
+		}
+		if err == io.EOF {
+			// The previous volume ended exactly at the end of the file
+			if copied == 0 && n > 1 {
+				os.Remove(name)
+				written = written[:len(written)-1]
+			}
+			break
+		}
+		if err != nil {
+			cleanup()
+			return 0, err
+		}
+	}
+
+	in.Close()
+	if err := os.Remove(path); err != nil {
+		cleanup()
+		return 0, err
+	}
+	return len(written), nil
+}
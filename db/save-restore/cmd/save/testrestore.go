@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backupfs"
+	"github.com/timescaledb-tools/save-restore/internal/ui"
+)
+
+// testRestoreOptions configures a test restore.
+type testRestoreOptions struct {
+	ScratchDir  string
+	PGBin       string
+	User        string
+	Timeout     time.Duration
+	KeepScratch bool
+
+	IgnoreLimits bool
+}
+
+// addTestRestoreFlags registers the test restore options on fs.
+func addTestRestoreFlags(fs *flag.FlagSet, opts *testRestoreOptions) {
+	fs.StringVar(&opts.ScratchDir, "scratch-dir", "", "Where to create the scratch data directory for test restores (default: system temp dir)")
+	fs.StringVar(&opts.PGBin, "pg-bin", "", "Directory with pg_ctl and postgres for test restores (default: from PATH)")
+	fs.DurationVar(&opts.Timeout, "test-restore-timeout", 10*time.Minute, "How long a test restore may take to start up")
+	fs.BoolVar(&opts.KeepScratch, "keep-scratch", false, "Keep the scratch data directory after a test restore")
+	fs.BoolVar(&opts.IgnoreLimits, "ignore-resource-limits", false, "Start the scratch server even if the host's limits look too low for the backup's shared_buffers")
+}
+
+// runTestRestore implements `save test-restore`, which checks an existing
+// backup by restoring it into a scratch directory and starting it.
+func runTestRestore(args []string) error {
+	fs := flag.NewFlagSet("test-restore", flag.ExitOnError)
+	opts := &testRestoreOptions{}
+	addTestRestoreFlags(fs, opts)
+	fs.StringVar(&opts.User, "user", getEnv("PGUSER", "postgres"), "Role to run the smoke test query as")
+	ui.AddColorFlag(fs)
+	ui.AddStrictFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: save test-restore [options] <backup>\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("test-restore needs a backup directory or .tar.zst archive")
+	}
+
+	printMsg(colorGreen, "PostgreSQL Backup Test Restore")
+	fmt.Println(strings.Repeat("=", 50))
+	return testRestore(fs.Arg(0), opts)
+}
+
+// restoreTimings are how long the phases of a test restore took.
+type restoreTimings struct {
+	Restore      time.Duration // laying the backup out as a data directory
+	RestoredSize int64         // size of that data directory
+	Start        time.Duration // until the server accepted connections, including WAL replay
+	Verify       time.Duration // the smoke test query
+}
+
+// testRestore restores backup into a fresh scratch directory, starts a
+// server on it with a private socket directory and no TCP listener, runs
+// SELECT 1 and shuts it down again. The scratch directory is removed
+// afterwards unless KeepScratch is set. Nothing outside the scratch
+// directory is touched.
+func testRestore(backup string, opts *testRestoreOptions) error {
+	_, err := timedTestRestore(backup, opts)
+	return err
+}
+
+// timedTestRestore is testRestore, reporting how long each phase took.
+func timedTestRestore(backup string, opts *testRestoreOptions) (timings *restoreTimings, err error) {
+	timings = &restoreTimings{}
+	pgCtl, err := findPGBinary(opts.PGBin, "pg_ctl")
+	if err != nil {
+		return nil, err
+	}
+	cred, err := serverCredential()
+	if err != nil {
+		return nil, err
+	}
+
+	scratch, err := os.MkdirTemp(opts.ScratchDir, "test-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer func() {
+		if opts.KeepScratch {
+			printMsg(colorYellow, "Keeping scratch directory "+scratch)
+			return
+		}
+		if rmErr := os.RemoveAll(scratch); rmErr != nil {
+			printMsg(colorRed, fmt.Sprintf("Failed to remove scratch directory %s: %v", scratch, rmErr))
+		}
+	}()
+	printMsg(colorBlue, "Scratch directory: "+scratch)
+
+	dataDir := filepath.Join(scratch, "data")
+	socketDir := filepath.Join(scratch, "socket")
+	logFile := filepath.Join(scratch, "postgres.log")
+	hbaFile := filepath.Join(scratch, "pg_hba.conf")
+
+	start := time.Now()
+	if err := stageBackup(backup, scratch, dataDir); err != nil {
+		return nil, fmt.Errorf("failed to restore into scratch directory: %w", err)
+	}
+	timings.Restore = time.Since(start)
+	timings.RestoredSize, _, _ = dirSize(dataDir)
+
+	// Tell host limits that keep the server from starting apart from a
+	// broken backup
+	if err := checkServerLimits(backup, dataDir, opts.IgnoreLimits); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(socketDir, 0700); err != nil {
+		return nil, err
+	}
+
+	// Only the scratch socket can reach the server, so trust is safe and
+	// means the backup's own pg_hba.conf does not get in the way
+	if err := os.WriteFile(hbaFile, []byte("local all all trust\n"), 0600); err != nil {
+		return nil, err
+	}
+
+	// Settings that would make the scratch server talk to the outside world
+	// are switched off; backup_label stays so the server recovers from the
+	// WAL included in the backup
+	for _, name := range []string{"recovery.signal", "standby.signal", "postmaster.pid", "postmaster.opts"} {
+		os.Remove(filepath.Join(dataDir, name))
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	if cred != nil {
+		if err := chownTree(scratch, cred.UID, cred.GID); err != nil {
+			return nil, fmt.Errorf("failed to hand the scratch directory to the postgres user: %w", err)
+		}
+	}
+
+	serverOpts := strings.Join([]string{
+		"-p " + strconv.Itoa(port),
+		"-c listen_addresses=''",
+		"-c unix_socket_directories='" + socketDir + "'",
+		"-c hba_file='" + hbaFile + "'",
+		"-c archive_mode=off",
+		"-c primary_conninfo=''",
+		"-c restore_command=''",
+	}, " ")
+
+	printMsg(colorBlue, fmt.Sprintf("Starting scratch server on socket %s, port %d...", socketDir, port))
+	start = time.Now()
+	startCmd := exec.Command(pgCtl, "start", "-D", dataDir, "-l", logFile, "-w",
+		"-t", strconv.Itoa(int(opts.Timeout.Seconds())), "-o", serverOpts)
+	runAs(startCmd, cred)
+	if out, err := startCmd.CombinedOutput(); err != nil {
+		printLogTail(logFile)
+		return nil, fmt.Errorf("scratch server failed to start: %w\n%s", err, strings.TrimSpace(string(out)))
+	}
+	timings.Start = time.Since(start)
+	defer func() {
+		stopCmd := exec.Command(pgCtl, "stop", "-D", dataDir, "-m", "fast", "-w")
+		runAs(stopCmd, cred)
+		if out, stopErr := stopCmd.CombinedOutput(); stopErr != nil {
+			printMsg(colorRed, fmt.Sprintf("Failed to stop scratch server: %v\n%s", stopErr, out))
+			if err == nil {
+				err = fmt.Errorf("failed to stop scratch server: %w", stopErr)
+			}
+			return
+		}
+		printMsg(colorGreen, "✓ Scratch server shut down")
+	}()
+	printMsg(colorGreen, fmt.Sprintf("✓ Scratch server started in %s", timings.Start.Round(time.Second)))
+
+	db, err := sql.Open("postgres", fmt.Sprintf("host=%s port=%d user=%s dbname=postgres sslmode=disable",
+		socketDir, port, opts.User))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	start = time.Now()
+	var one int
+	if err := db.QueryRow("SELECT 1").Scan(&one); err != nil || one != 1 {
+		printLogTail(logFile)
+		return nil, fmt.Errorf("smoke test query failed: %v", err)
+	}
+	timings.Verify = time.Since(start)
+	printMsg(colorGreen, "✓ SELECT 1 succeeded")
+
+	printMsg(colorGreen, "\n✓ Test restore passed")
+	return timings, nil
+}
+
+// stageBackup lays the backup out as a data directory in dataDir: archives
+// are unpacked first, tar backups extracted like `save convert`, plain
+// backups copied.
+func stageBackup(backup, scratch, dataDir string) error {
+	src := backup
+	if info, err := os.Stat(backup); err != nil {
+		return err
+	} else if !info.IsDir() {
+		if !strings.HasSuffix(backup, backupfs.ArchiveSuffix) {
+			return fmt.Errorf("%s is neither a backup directory nor a %s archive", backup, backupfs.ArchiveSuffix)
+		}
+		printMsg(colorBlue, "Unpacking "+filepath.Base(backup))
+		dir, err := backupfs.UnpackArchive(backup, filepath.Join(scratch, "archive"))
+		if err != nil {
+			return err
+		}
+		src = dir
+	}
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return err
+	}
+
+	// Tablespaces are restored into the scratch directory too, so the
+	// scratch server never writes to the source's tablespace locations
+	tablespaceDir := filepath.Join(scratch, "tablespaces")
+	switch {
+	case findTar(src, "base") != "":
+		return tarToPlain(src, dataDir, tablespaceDir)
+	case fileExists(filepath.Join(src, "PG_VERSION")):
+		printMsg(colorBlue, "Copying plain backup")
+		if err := copyTree(src, dataDir); err != nil {
+			return err
+		}
+		return copyPlainTablespaces(dataDir, tablespaceDir)
+	}
+	return fmt.Errorf("no plain or tar backup found in %s", src)
+}
+
+// copyTree copies the contents of src into dst, keeping modes and links.
+func copyTree(src, dst string) error {
+	out, err := exec.Command("cp", "-a", src+"/.", dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("copy failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// copyPlainTablespaces copies the tablespaces the pg_tblspc links of a
+// plain backup point to into tablespaceDir/<oid> and relinks them there.
+func copyPlainTablespaces(dataDir, tablespaceDir string) error {
+	entries, _ := os.ReadDir(filepath.Join(dataDir, "pg_tblspc"))
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := os.Readlink(filepath.Join(dataDir, "pg_tblspc", entry.Name()))
+		if err != nil {
+			return err
+		}
+		location := filepath.Join(tablespaceDir, entry.Name())
+		printMsg(colorBlue, fmt.Sprintf("Copying tablespace %s from %s", entry.Name(), target))
+		if err := os.MkdirAll(location, 0700); err != nil {
+			return err
+		}
+		if err := copyTree(target, location); err != nil {
+			return fmt.Errorf("tablespace %s: %w", entry.Name(), err)
+		}
+		if err := relinkTablespace(dataDir, entry.Name(), location); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findPGBinary locates a PostgreSQL server binary in dir or on PATH.
+func findPGBinary(dir, name string) (string, error) {
+	if dir != "" {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("%s not found in %s", name, dir)
+		}
+		return path, nil
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("%s not found on PATH (the PostgreSQL server package is needed, or set --pg-bin)", name)
+	}
+	return path, nil
+}
+
+// serverUser is a user the scratch server runs as instead of the current one.
+type serverUser struct {
+	UID int
+	GID int
+}
+
+// serverCredential returns who the scratch server runs as. PostgreSQL
+// refuses to run as root, so as root it runs as the postgres user; otherwise,
+// with a nil user, as the current user.
+func serverCredential() (*serverUser, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+	u, err := user.Lookup("postgres")
+	if err != nil {
+		return nil, fmt.Errorf("running as root and no postgres user to start the scratch server as: %w", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	return &serverUser{UID: uid, GID: gid}, nil
+}
+
+func chownTree(root string, uid, gid int) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, uid, gid)
+	})
+}
+
+// freePort picks a TCP port nothing is listening on. The scratch server does
+// not listen on TCP, but the port also names its socket file, and a free one
+// keeps it clear of anything else on the host.
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %w", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// printLogTail shows the end of the scratch server's log after a failure.
+func printLogTail(logFile string) {
+	f, err := os.Open(logFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if len(lines) > 20 {
+			lines = lines[1:]
+		}
+	}
+	if len(lines) > 0 {
+		printMsg(colorYellow, "Last lines of the scratch server log:")
+		for _, line := range lines {
+			fmt.Fprintln(ui.Output(), "  "+line)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// Validate checks the whole configuration before anything is run and reports
+// every problem it finds, not just the first. parseFlags calls it after the
+// flags are parsed; code filling in a Config itself should do the same.
+func (c *Config) Validate() error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.Host == "" {
+		add("--host must not be empty")
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		add("invalid --port %d (expected 1-65535)", c.Port)
+	}
+	if c.User == "" {
+		add("--user must not be empty")
+	}
+	if isSecretRef(c.Password) {
+		if _, _, _, err := parseSecretRef(c.Password); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.BackupDir == "" {
+		add("--backup-dir must not be empty")
+	}
+
+	if c.Format != "tar" && c.Format != "plain" {
+		add("invalid --format %q (expected tar or plain)", c.Format)
+	}
+	if c.Compress < 0 || c.Compress > 9 {
+		add("invalid --compress %d (expected 0-9)", c.Compress)
+	}
+	if c.Checkpoint != "fast" && c.Checkpoint != "spread" {
+		add("invalid --checkpoint %q (expected fast or spread)", c.Checkpoint)
+	}
+	if c.OnFailure != "cleanup" && c.OnFailure != "keep" {
+		add("invalid --on-failure value %q (expected cleanup or keep)", c.OnFailure)
+	}
+
+	if c.ArchiveTar && c.Format != "tar" {
+		add("--archive-tar requires --format tar")
+	}
+	if c.ArchiveLevel < 1 || c.ArchiveLevel > 22 {
+		add("--archive-level must be between 1 and 22")
+	}
+	if err := validateCompressFlags(c); err != nil {
+		errs = append(errs, err)
+	}
+	if c.SplitSize < 0 {
+		add("--split-size must not be negative")
+	}
+	if c.SplitSize > 0 && c.Format != "tar" {
+		add("--split-size requires --format tar")
+	}
+	if c.SplitSize > 0 && c.ArchiveTar {
+		add("--split-size cannot be combined with --archive-tar")
+	}
+	if c.ConnectRetries < 0 {
+		add("--connect-retries must not be negative")
+	}
+	if c.ConnectRetryDelay < 0 {
+		add("--connect-retry-delay must not be negative")
+	}
+	if c.LockTimeout < 0 {
+		add("--lock-timeout must not be negative")
+	}
+	if c.MaxClockSkew < 0 {
+		add("--max-clock-skew must not be negative")
+	}
+	if c.SkipThreshold < 0 {
+		add("--skip-threshold must not be negative")
+	}
+
+	if (len(c.SourceSettings) > 0 || c.RecommendedConf) && !c.RecordSourceSettings {
+		add("--source-setting and --recommended-conf need --record-source-settings")
+	}
+	if err := validateSourceSettings(c.SourceSettings); err != nil {
+		errs = append(errs, err)
+	}
+
+	if (len(c.RedactFields) > 0 || c.RedactHash) && !c.RedactManifest {
+		add("--redact-field and --redact-hash need --redact-manifest")
+	}
+	if err := manifest.ValidateRedactFields(c.RedactFields); err != nil {
+		errs = append(errs, err)
+	}
+
+	// Refuse exclusions that would break the backup
+	if err := validateExcludes(c.Exclude); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// walArchiveName matches the files restore_command is asked for: WAL
+// segments and timeline history files.
+var walArchiveName = regexp.MustCompile(`^([0-9A-F]{24}|[0-9A-F]{8}\.history)$`)
+
+// archiveWAL copies the completed WAL segments streamed into the backup into
+// --wal-archive-dir for point-in-time recovery. That only covers the WAL up
+// to the backup's stop point: save does not archive WAL written later, so
+// unless something else, such as pg_receivewal, keeps the archive filled it
+// warns that targets past the backup cannot be reached. The segment holding
+// the stop LSN is only partly written and is left out. Files already in the
+// archive are kept.
+func archiveWAL(config *Config, result *BackupResult) error {
+	if config.DryRun {
+		printMsg(colorYellow, "DRY RUN: Would copy WAL segments to "+config.WALArchiveDir)
+		return nil
+	}
+
+	printMsg(colorBlue, "\nCopying WAL segments to "+config.WALArchiveDir+"...")
+	if err := os.MkdirAll(config.WALArchiveDir, 0750); err != nil {
+		return fmt.Errorf("failed to create WAL archive directory: %w", err)
+	}
+
+	// Without the stop segment nothing tells which segments are complete
+	segmentSize, err := walSegmentSize(config)
+	if err != nil {
+		warn("Could not read wal_segment_size, not archiving WAL: " + err.Error())
+		return nil
+	}
+	stopSegment, err := walFileName(result.Timeline, result.StopLSN, segmentSize)
+	if err != nil {
+		warn("Unknown stop LSN, not archiving WAL: " + err.Error())
+		return nil
+	}
+
+	copied, skipped := 0, 0
+	store := func(name string, r io.Reader) error {
+		if !walArchiveName.MatchString(name) || (!strings.HasSuffix(name, ".history") && name >= stopSegment) {
+			return nil
+		}
+		stored, err := storeWALFile(config.WALArchiveDir, name, r)
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %w", name, err)
+		}
+		if stored {
+			copied++
+		} else {
+			skipped++
+		}
+		return nil
+	}
+
+	if config.Format == "plain" {
+		err = walFromDir(filepath.Join(result.Path, "pg_wal"), store)
+	} else {
+		err = walFromTar(result.Path, store)
+	}
+	if err != nil {
+		return err
+	}
+
+	printMsg(colorGreen, fmt.Sprintf("✓ Archived %d WAL files up to %s (%d already archived)", copied, stopSegment, skipped))
+	if !archivedContinuously(config.WALArchiveDir, stopSegment) {
+		warn("--wal-archive-dir only holds the WAL up to the end of this backup; " +
+			"run pg_receivewal or an archive_command into " + config.WALArchiveDir + " to recover to later points in time")
+	}
+	return nil
+}
+
+// archivedContinuously reports whether something else is writing WAL into
+// dir: pg_receivewal or an archive_command has the stop segment, completed
+// or still being written as a .partial file, which save leaves out.
+func archivedContinuously(dir, stopSegment string) bool {
+	for _, name := range []string{stopSegment, stopSegment + ".partial"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// walFileName returns the name of the WAL segment holding lsn on timeline.
+func walFileName(timeline int, lsn string, segmentSize int64) (string, error) {
+	hi, lo, found := strings.Cut(lsn, "/")
+	if !found || timeline == 0 || segmentSize <= 0 {
+		return "", fmt.Errorf("invalid LSN %q on timeline %d", lsn, timeline)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid LSN %q", lsn)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid LSN %q", lsn)
+	}
+
+	segment := (h<<32 | l) / uint64(segmentSize)
+	perID := uint64(0x100000000) / uint64(segmentSize)
+	return fmt.Sprintf("%08X%08X%08X", timeline, segment/perID, segment%perID), nil
+}
+
+// walFromDir hands every file in a plain backup's pg_wal to store.
+func walFromDir(dir string, store func(name string, r io.Reader) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dir, err)
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		f, err := os.Open(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+		err = store(entry.Name(), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walFromTar hands every file in a tar backup's pg_wal.tar[.gz] to store.
+func walFromTar(backupPath string, store func(name string, r io.Reader) error) error {
+	tarFile := findTar(backupPath, "pg_wal")
+	if tarFile == "" {
+		return fmt.Errorf("no pg_wal.tar in %s", backupPath)
+	}
+
+	file, err := os.Open(tarFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	r, err := decompress(tarFile, file)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", filepath.Base(tarFile), err)
+	}
+	defer r.Close()
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", filepath.Base(tarFile), err)
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if header.Typeflag != tar.TypeReg || strings.Contains(name, "/") {
+			continue
+		}
+		if err := store(name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// storeWALFile writes one WAL file into the archive under a temporary name
+// and renames it into place, so restore_command never sees a partial copy.
+// It reports false if the archive already has the file.
+func storeWALFile(dir, name string, r io.Reader) (bool, error) {
+	target := filepath.Join(dir, name)
+	if _, err := os.Stat(target); err == nil {
+		return false, nil
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+name+".*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Chmod(tmp.Name(), 0640); err != nil {
+		return false, err
+	}
+	return true, os.Rename(tmp.Name(), target)
+}
@@ -2,4 +2,9 @@ module github.com/timescaledb-tools/save-restore
 
 go 1.22
 
-require github.com/lib/pq v1.10.9
\ No newline at end of file
+require (
+	github.com/klauspost/compress v1.17.11
+	github.com/klauspost/pgzip v1.2.6
+	github.com/lib/pq v1.10.9
+	github.com/pierrec/lz4/v4 v4.1.30
+)
@@ -0,0 +1,285 @@
+// Package backupfs holds the file system helpers both tools use on backups:
+// the path checks that keep them from writing outside the directories they
+// are given, reading tar files split into volumes and unpacking the
+// single-file archives made by save --archive-tar.
+package backupfs
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/timescaledb-tools/save-restore/internal/manifest"
+)
+
+// ArchiveSuffix is the extension of single-file archives made by
+// save --archive-tar.
+const ArchiveSuffix = ".tar.zst"
+
+// TarSuffixes are the extensions of the tar files in a backup directory, in
+// the order they are preferred when two files share a name. pg_basebackup
+// writes .tar.zst and .tar.lz4 with --compress=zstd or lz4 (PostgreSQL 15
+// and later).
+var TarSuffixes = []string{".tar.gz", ".tar.zst", ".tar.lz4", ".tar"}
+
+// Within reports whether path is dir or lies below it. Both are compared as
+// given; use Resolve first where symlinks matter.
+func Within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Resolve returns path made absolute with its symlinks resolved. The part
+// of path that does not exist yet is kept as it is, appended to its
+// resolved parent.
+func Resolve(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		}
+		if !os.IsNotExist(err) || dir == filepath.Dir(dir) {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(dir)}, missing...)
+	}
+}
+
+// Dest is a directory tar members are extracted into. Member keeps every
+// member inside it, including through symlinks earlier members created.
+type Dest struct {
+	path     string
+	resolved string
+}
+
+// NewDest returns the Dest for path, which has to exist.
+func NewDest(path string) (*Dest, error) {
+	resolved, err := Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Dest{path: filepath.Clean(path), resolved: resolved}, nil
+}
+
+// Member returns where header is extracted to, or skip for the
+// pg_tblspc/<oid> symlinks, which the tools link to the tablespace's new
+// location themselves. It refuses members whose name, symlink target or
+// hard link target leads outside the directory, resolving the symlinks on
+// the way: a symlink member is checked by where it points from its own
+// directory and by its resolved parent, every other member by its resolved
+// path, so writing through a link an earlier member made cannot escape.
+func (d *Dest) Member(header *tar.Header) (target string, skip bool, err error) {
+	target = filepath.Join(d.path, header.Name)
+	if !Within(d.path, target) {
+		return "", false, fmt.Errorf("%s: member would be extracted outside %s", header.Name, d.path)
+	}
+
+	resolve := target
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if isTablespaceLink(d.path, target) {
+			return "", true, nil
+		}
+		linkTarget := header.Linkname
+		if !filepath.IsAbs(linkTarget) {
+			linkTarget = filepath.Join(filepath.Dir(target), linkTarget)
+		}
+		if !d.within(linkTarget) {
+			return "", false, fmt.Errorf("%s: symlink to %s points outside %s", header.Name, header.Linkname, d.path)
+		}
+		// The link itself is replaced, only where it is created matters
+		resolve = filepath.Dir(target)
+	case tar.TypeLink:
+		if !d.within(filepath.Join(d.path, header.Linkname)) {
+			return "", false, fmt.Errorf("%s: hard link to %s points outside %s", header.Name, header.Linkname, d.path)
+		}
+	}
+
+	resolved, err := Resolve(resolve)
+	if err != nil {
+		return "", false, fmt.Errorf("%s: %w", header.Name, err)
+	}
+	if resolve == target {
+		// Resolve keeps a dangling link as it is, but writing to one
+		// creates the file it points to
+		if info, err := os.Lstat(target); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if resolved, err = filepath.EvalSymlinks(target); err != nil {
+				return "", false, fmt.Errorf("%s: existing symlink does not resolve: %w", header.Name, err)
+			}
+		}
+	}
+	if !Within(d.resolved, resolved) {
+		return "", false, fmt.Errorf("%s: member would be extracted outside %s through a symlink", header.Name, d.path)
+	}
+	return target, false, nil
+}
+
+// within reports whether path lies inside the directory both as written
+// and with its symlinks resolved.
+func (d *Dest) within(path string) bool {
+	if !Within(d.path, path) {
+		return false
+	}
+	resolved, err := Resolve(path)
+	return err == nil && Within(d.resolved, resolved)
+}
+
+// isTablespaceLink reports whether target is pg_tblspc/<oid> below dir.
+func isTablespaceLink(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil {
+		return false
+	}
+	parent, oid := filepath.Split(rel)
+	if filepath.Clean(parent) != "pg_tblspc" || oid == "" {
+		return false
+	}
+	return strings.Trim(oid, "0123456789") == ""
+}
+
+// VolumeParts returns the files holding the tar file path: path itself, or
+// its volumes in order when save --split-size split it. The parts end at the
+// first missing number.
+func VolumeParts(path string) []string {
+	if _, err := os.Stat(path); err == nil {
+		return []string{path}
+	}
+
+	var parts []string
+	for n := 1; ; n++ {
+		part := manifest.VolumeName(path, n)
+		if _, err := os.Stat(part); err != nil {
+			return parts
+		}
+		parts = append(parts, part)
+	}
+}
+
+// volumeReader reads the volumes of a split file one after the other.
+type volumeReader struct {
+	io.Reader
+	files []*os.File
+}
+
+func (v *volumeReader) Close() error {
+	var firstErr error
+	for _, f := range v.files {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// OpenVolumes opens the tar file path, or when it was split, its volumes in
+// order.
+func OpenVolumes(path string) (io.ReadCloser, error) {
+	parts := VolumeParts(path)
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%s not found: %w", path, os.ErrNotExist)
+	}
+
+	v := &volumeReader{}
+	var readers []io.Reader
+	for _, part := range parts {
+		f, err := os.Open(part)
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.files = append(v.files, f)
+		readers = append(readers, f)
+	}
+	v.Reader = io.MultiReader(readers...)
+	return v, nil
+}
+
+// UnpackArchive extracts the .tar.zst archive at path into dst and returns
+// the backup directory in it: save --archive-tar stores every member under
+// a single "<backup name>/" directory of regular files. Members that would
+// land outside dst, and links, which could lead there, are refused.
+func UnpackArchive(path, dst string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer file.Close()
+
+	zr, err := zstd.NewReader(file)
+	if err != nil {
+		return "", fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zr.Close()
+
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return "", err
+	}
+
+	tarReader := tar.NewReader(zr)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive header: %w", err)
+		}
+
+		target := filepath.Join(dst, header.Name)
+		if !Within(dst, target) {
+			return "", fmt.Errorf("archive member %s escapes %s", header.Name, dst)
+		}
+		if target == filepath.Clean(dst) {
+			continue
+		}
+		mode := os.FileMode(header.Mode).Perm()
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return "", fmt.Errorf("failed to create directory: %w", err)
+			}
+			if err := os.Chmod(target, mode); err != nil {
+				return "", err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return "", fmt.Errorf("failed to create parent directory: %w", err)
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return "", fmt.Errorf("failed to create file: %w", err)
+			}
+			if _, err := io.Copy(out, tarReader); err != nil {
+				out.Close()
+				return "", fmt.Errorf("failed to unpack %s: %w", header.Name, err)
+			}
+			if err := out.Close(); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("unsupported archive member %s", header.Name)
+		}
+		os.Chtimes(target, header.ModTime, header.ModTime)
+	}
+
+	entries, err := os.ReadDir(dst)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", dst, err)
+	}
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return "", fmt.Errorf("unexpected archive layout in %s: expected a single backup directory", path)
+	}
+	return filepath.Join(dst, entries[0].Name()), nil
+}
@@ -0,0 +1,125 @@
+// Package backuplabel parses the backup_label file pg_basebackup writes into
+// every base backup. It records where WAL replay has to start and is the most
+// direct description of the point in time a backup represents.
+package backuplabel
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// FileName is the name of the file in the data directory.
+const FileName = "backup_label"
+
+// Label holds the fields of a backup_label file.
+type Label struct {
+	StartWALLocation   string `json:"start_wal_location"`
+	StartWALFile       string `json:"start_wal_file,omitempty"`
+	CheckpointLocation string `json:"checkpoint_location"`
+	BackupMethod       string `json:"backup_method,omitempty"`
+	BackupFrom         string `json:"backup_from,omitempty"`
+	StartTime          string `json:"start_time"`
+	Label              string `json:"label,omitempty"`
+	StartTimeline      int    `json:"start_timeline,omitempty"`
+}
+
+// Parse reads a backup_label file.
+func Parse(r io.Reader) (*Label, error) {
+	label := &Label{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ": ")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case "START WAL LOCATION":
+			// "0/2000028 (file 000000010000000000000002)"
+			location, file, _ := strings.Cut(value, " ")
+			label.StartWALLocation = location
+			label.StartWALFile = strings.TrimSuffix(strings.TrimPrefix(file, "(file "), ")")
+		case "CHECKPOINT LOCATION":
+			label.CheckpointLocation = value
+		case "BACKUP METHOD":
+			label.BackupMethod = value
+		case "BACKUP FROM":
+			label.BackupFrom = value
+		case "START TIME":
+			label.StartTime = value
+		case "LABEL":
+			label.Label = value
+		case "START TIMELINE":
+			label.StartTimeline, _ = strconv.Atoi(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if label.StartWALLocation == "" {
+		return nil, fmt.Errorf("not a backup_label file: missing START WAL LOCATION")
+	}
+	return label, nil
+}
+
+// ReadFile parses the backup_label file at path.
+func ReadFile(path string) (*Label, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Parse(f)
+}
+
+// FromTar scans an uncompressed tar stream for backup_label and parses it.
+// pg_basebackup writes the file first, so this rarely reads far.
+func FromTar(r io.Reader) (*Label, error) {
+	tarReader := tar.NewReader(r)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s not found in archive", FileName)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.TrimPrefix(header.Name, "./") == FileName {
+			return Parse(tarReader)
+		}
+	}
+}
+
+// Print writes the label's fields in a readable form, one per line, each
+// prefixed with indent.
+func (l *Label) Print(w io.Writer, indent string) {
+	fmt.Fprintf(w, "%sStart time:          %s\n", indent, l.StartTime)
+	fmt.Fprintf(w, "%sStart WAL location:  %s", indent, l.StartWALLocation)
+	if l.StartWALFile != "" {
+		fmt.Fprintf(w, " (file %s)", l.StartWALFile)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "%sCheckpoint location: %s\n", indent, l.CheckpointLocation)
+	if l.StartTimeline != 0 {
+		fmt.Fprintf(w, "%sTimeline:            %d\n", indent, l.StartTimeline)
+	}
+	if l.BackupMethod != "" {
+		fmt.Fprintf(w, "%sBackup method:       %s", indent, l.BackupMethod)
+		if l.BackupFrom != "" {
+			fmt.Fprintf(w, " from %s", l.BackupFrom)
+		}
+		fmt.Fprintln(w)
+	}
+	if l.Label != "" {
+		fmt.Fprintf(w, "%sLabel:               %s\n", indent, l.Label)
+	}
+}
@@ -0,0 +1,356 @@
+// Package manifest reads and writes the metadata the save tool stores next to
+// each backup. It is separate from the backup_manifest file pg_basebackup
+// writes, which only describes the data directory contents.
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/timescaledb-tools/save-restore/internal/backuplabel"
+)
+
+const (
+	// FileName is the manifest file written into every backup directory.
+	FileName = "manifest.json"
+
+	// ChecksumsFileName holds sha256sum-compatible checksums of the backup files.
+	ChecksumsFileName = "SHA256SUMS"
+
+	// SettingsFileName is the postgresql.conf snippet save --recommended-conf
+	// writes with the source's settings.
+	SettingsFileName = "recommended_postgresql.conf"
+
+	// RedactedFileName is the sanitized copy of the manifest written by
+	// save redact and save --redact-manifest.
+	RedactedFileName = "manifest.redacted.json"
+
+	// RunbookFileName is the restore runbook written by save runbook and
+	// save --runbook.
+	RunbookFileName = "RESTORE.md"
+
+	// GlobalsFileName is the pg_dumpall --globals-only output written by
+	// save --dump-globals.
+	GlobalsFileName = "globals.sql"
+
+	// BackupPrefix is the directory name prefix of backups created by the save tool.
+	BackupPrefix = "cluster_backup_"
+
+	// LatestFileName records the latest backup save wrote into a backup
+	// directory (see RecordLatest).
+	LatestFileName = ".latest_backup.json"
+
+	currentVersion = 1
+)
+
+// MetadataFiles are the files the save tool adds to a backup directory.
+// They are not part of the data directory.
+var MetadataFiles = []string{FileName, ChecksumsFileName, SettingsFileName, RedactedFileName, RunbookFileName, GlobalsFileName}
+
+// Manifest describes a single backup.
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Host      string    `json:"host"`
+	Port      int       `json:"port"`
+	Format    string    `json:"format"`
+	Compress  int       `json:"compress"`
+	StartLSN  string    `json:"start_lsn,omitempty"`
+	StopLSN   string    `json:"stop_lsn,omitempty"`
+	Timeline  int       `json:"timeline,omitempty"`
+	Size      int64     `json:"size"`
+	Files     []File    `json:"files"`
+	Verified  bool      `json:"verified"`
+
+	BackupLabel *backuplabel.Label `json:"backup_label,omitempty"`
+	Extensions  []Extension        `json:"extensions,omitempty"`
+	Volumes     []Volume           `json:"volumes,omitempty"`
+
+	// DataChecksums is the source cluster's data_checksums setting ("on"
+	// or "off"), empty for backups made before it was recorded.
+	DataChecksums string `json:"data_checksums,omitempty"`
+
+	// WALSegmentSize is the source cluster's WAL segment size in bytes.
+	WALSegmentSize int64 `json:"wal_segment_size,omitempty"`
+
+	// PGVersion is the major version of the source cluster, as in its
+	// PG_VERSION file.
+	PGVersion string `json:"pg_version,omitempty"`
+
+	// SystemIdentifier is the source cluster's database system identifier
+	// from pg_control, which a standby shares with its primary.
+	SystemIdentifier string `json:"system_identifier,omitempty"`
+
+	// Settings are the values of the source's server settings recorded with
+	// --record-source-settings, as SHOW prints them.
+	Settings map[string]string `json:"settings,omitempty"`
+
+	// WALArchive is the --wal-archive-dir the backup's WAL was copied to,
+	// where point-in-time recovery finds the WAL written after it.
+	WALArchive string `json:"wal_archive,omitempty"`
+
+	// Compression is "zstd" or "lz4" for tar backups pg_basebackup
+	// compressed that way (PostgreSQL 15 and later), found by
+	// `save reindex`. Compress is 0 then, as the files do not record
+	// their level.
+	Compression string `json:"compression,omitempty"`
+
+	// Tablespaces are the source's tablespaces other than pg_default and
+	// pg_global. Tar-format backups hold each in <oid>.tar[.gz].
+	Tablespaces []Tablespace `json:"tablespaces,omitempty"`
+
+	// Globals names the file with the source's roles, role memberships and
+	// tablespace definitions, dumped with save --dump-globals for logical
+	// restores.
+	Globals string `json:"globals,omitempty"`
+
+	// Clock compares the backup host's clock with the server's when the
+	// backup started. Backup names and CreatedAt come from the former,
+	// backup_label times from the latter.
+	Clock *Clock `json:"clock,omitempty"`
+
+	// Reindexed is set when the manifest was written afterwards by
+	// `save reindex` from what could be read off the backup itself.
+	Reindexed bool `json:"reindexed,omitempty"`
+
+	// Redacted lists the fields removed or hashed in a copy of the manifest
+	// made for sharing (manifest.redacted.json).
+	Redacted []string `json:"redacted,omitempty"`
+}
+
+// Clock holds the two clocks read at the same moment, as far as the round
+// trip to the server allows.
+type Clock struct {
+	Local  time.Time `json:"local"`
+	Server time.Time `json:"server"`
+}
+
+// Skew is how far the server's clock is ahead of the backup host's,
+// negative when it is behind.
+func (c *Clock) Skew() time.Duration {
+	return c.Server.Sub(c.Local)
+}
+
+// Volume is a tar file stored as numbered parts (base.tar.gz.001, .002, ...)
+// by save --split-size. Concatenating the parts in order gives the original.
+type Volume struct {
+	Name  string `json:"name"`
+	Parts int    `json:"parts"`
+	Size  int64  `json:"size"`
+}
+
+// VolumeName returns the file name of part n (counting from 1) of name.
+func VolumeName(name string, n int) string {
+	return fmt.Sprintf("%s.%03d", name, n)
+}
+
+// Tablespace is a tablespace of the source cluster and where it was at the
+// time of the backup.
+type Tablespace struct {
+	OID      uint32 `json:"oid"`
+	Name     string `json:"name"`
+	Location string `json:"location"`
+}
+
+// Extension is an extension installed in one of the cluster's databases.
+type Extension struct {
+	Database string `json:"database"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+}
+
+// File is a single file of a backup, relative to the backup directory.
+type File struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// New returns a manifest with the current format version.
+func New() *Manifest {
+	return &Manifest{Version: currentVersion, CreatedAt: time.Now().UTC()}
+}
+
+// Read loads the manifest of the backup in dir.
+func Read(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, FileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest in %s: %w", dir, err)
+	}
+	return &m, nil
+}
+
+// Write stores the manifest in dir.
+func (m *Manifest) Write(dir string) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, FileName), append(data, '\n'), 0644)
+}
+
+// CheckFiles makes sure every file the manifest lists is present in dir with
+// the recorded size. It is a quick structural check that does not read the
+// files; SHA256SUMS is there for a full check.
+func (m *Manifest) CheckFiles(dir string) error {
+	if len(m.Files) == 0 {
+		return fmt.Errorf("manifest lists no files")
+	}
+	for _, f := range m.Files {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f.Name)))
+		if err != nil {
+			return fmt.Errorf("missing %s", f.Name)
+		}
+		if info.Size() != f.Size {
+			return fmt.Errorf("%s is %d bytes, expected %d", f.Name, info.Size(), f.Size)
+		}
+	}
+	return nil
+}
+
+// CollectFiles records the size and checksum of every file in dir, skipping
+// the manifest and checksum files themselves, and sets the total size.
+func (m *Manifest) CollectFiles(dir string) error {
+	var files []File
+	var total int64
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == FileName || rel == ChecksumsFileName {
+			return nil
+		}
+
+		sum, err := hashFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to checksum %s: %w", rel, err)
+		}
+
+		files = append(files, File{Name: rel, Size: info.Size(), SHA256: sum})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	m.Files = files
+	m.Size = total
+	return nil
+}
+
+// WriteChecksums writes the recorded file checksums in sha256sum format so the
+// backup can be checked with `sha256sum -c SHA256SUMS`.
+func (m *Manifest) WriteChecksums(dir string) error {
+	var b strings.Builder
+	for _, f := range m.Files {
+		fmt.Fprintf(&b, "%s  %s\n", f.SHA256, f.Name)
+	}
+	return os.WriteFile(filepath.Join(dir, ChecksumsFileName), []byte(b.String()), 0644)
+}
+
+// latestRecord is the content of LatestFileName: the manifest of the latest
+// backup written into a directory, without its file list, and where that
+// backup is.
+type latestRecord struct {
+	Path     string    `json:"path"`
+	Manifest *Manifest `json:"manifest"`
+}
+
+// RecordLatest notes in dir that the backup at path, a directory or a
+// .tar.zst archive described by m, is the latest one written there. Latest
+// finds archives and backups named with --output-dir through it, whose
+// manifests it cannot read from the directory listing.
+func RecordLatest(dir, path string, m *Manifest) error {
+	summary := *m
+	summary.Files = nil
+	data, err := json.MarshalIndent(latestRecord{Path: path, Manifest: &summary}, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, "."+LatestFileName+".tmp")
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, LatestFileName))
+}
+
+// Latest returns the most recent backup under root, along with its path:
+// the newest backup directory with a manifest, whatever its name, or the
+// backup recorded with RecordLatest if it is newer and still there. It
+// returns os.ErrNotExist if there is none.
+func Latest(root string) (*Manifest, string, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var latest *Manifest
+	var latestDir string
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		dir := filepath.Join(root, entry.Name())
+		m, err := Read(dir)
+		if err != nil {
+			continue
+		}
+		if latest == nil || m.CreatedAt.After(latest.CreatedAt) {
+			latest, latestDir = m, dir
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(root, LatestFileName)); err == nil {
+		var record latestRecord
+		if json.Unmarshal(data, &record) == nil && record.Manifest != nil {
+			if _, err := os.Stat(record.Path); err == nil && (latest == nil || record.Manifest.CreatedAt.After(latest.CreatedAt)) {
+				latest, latestDir = record.Manifest, record.Path
+			}
+		}
+	}
+
+	if latest == nil {
+		return nil, "", os.ErrNotExist
+	}
+	return latest, latestDir, nil
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,161 @@
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// DefaultRedactFields are the fields Redact removes unless told otherwise:
+// the ones that describe the source's hosts, databases and configuration.
+var DefaultRedactFields = []string{
+	"host",
+	"port",
+	"extensions.database",
+	"settings",
+	"tablespaces.name",
+	"tablespaces.location",
+	"backup_label.label",
+}
+
+// requiredFields are needed to verify and restore a backup and are never
+// redacted.
+var requiredFields = map[string]bool{
+	"version":                          true,
+	"format":                           true,
+	"compress":                         true,
+	"size":                             true,
+	"files":                            true,
+	"volumes":                          true,
+	"start_lsn":                        true,
+	"stop_lsn":                         true,
+	"timeline":                         true,
+	"data_checksums":                   true,
+	"wal_segment_size":                 true,
+	"pg_version":                       true,
+	"tablespaces.oid":                  true,
+	"backup_label.start_wal_location":  true,
+	"backup_label.start_wal_file":      true,
+	"backup_label.checkpoint_location": true,
+	"backup_label.start_timeline":      true,
+}
+
+// ValidateRedactFields checks that every field names a manifest field that
+// may be redacted. Fields are JSON names, with a dot for the fields of
+// nested objects and of each element of a list ("extensions.database"), or
+// for single settings ("settings.shared_preload_libraries", "settings.*").
+func ValidateRedactFields(fields []string) error {
+	for _, field := range fields {
+		for required := range requiredFields {
+			if strings.HasPrefix(required, field+".") {
+				return fmt.Errorf("cannot redact %s: it holds fields needed to verify and restore the backup", field)
+			}
+		}
+		for prefix := field; prefix != ""; {
+			if requiredFields[prefix] {
+				return fmt.Errorf("cannot redact %s: %s is needed to verify and restore the backup", field, prefix)
+			}
+			i := strings.LastIndex(prefix, ".")
+			if i < 0 {
+				break
+			}
+			prefix = prefix[:i]
+		}
+		if !knownField(reflect.TypeOf(Manifest{}), strings.Split(field, ".")) {
+			return fmt.Errorf("unknown manifest field %q", field)
+		}
+	}
+	return nil
+}
+
+// knownField reports whether path names a field of t.
+func knownField(t reflect.Type, path []string) bool {
+	for t.Kind() == reflect.Pointer || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	if len(path) == 0 {
+		return true
+	}
+
+	switch t.Kind() {
+	case reflect.Map:
+		return len(path) == 1 && path[0] != ""
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+			if name == path[0] {
+				return knownField(t.Field(i).Type, path[1:])
+			}
+		}
+	}
+	return false
+}
+
+// Redact returns a copy of the manifest as JSON without the given fields.
+// With hash set, string values are replaced by a short SHA-256 of the value
+// instead, so equal values can still be matched up; other values are
+// removed. The redacted fields are listed in Redacted.
+func (m *Manifest) Redact(fields []string, hash bool) ([]byte, error) {
+	if err := ValidateRedactFields(fields); err != nil {
+		return nil, err
+	}
+
+	redacted := *m
+	redacted.Redacted = fields
+	data, err := json.Marshal(&redacted)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		redactPath(doc, strings.Split(field, "."), hash)
+	}
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
+
+// redactPath redacts path below value, descending into objects and into
+// every element of lists.
+func redactPath(value any, path []string, hash bool) {
+	switch v := value.(type) {
+	case []any:
+		for _, element := range v {
+			redactPath(element, path, hash)
+		}
+	case map[string]any:
+		keys := []string{path[0]}
+		if path[0] == "*" {
+			keys = keys[:0]
+			for key := range v {
+				keys = append(keys, key)
+			}
+		}
+		for _, key := range keys {
+			child, ok := v[key]
+			if !ok {
+				continue
+			}
+			if len(path) > 1 {
+				redactPath(child, path[1:], hash)
+				continue
+			}
+			if s, isString := child.(string); isString && hash {
+				sum := sha256.Sum256([]byte(s))
+				v[key] = "sha256:" + hex.EncodeToString(sum[:8])
+			} else {
+				delete(v, key)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package pgservice reads libpq's connection service files (pg_service.conf),
+// which name connection profiles such as [prod-metrics] with their host,
+// port, user, dbname and sslmode. lib/pq does not support services, and
+// refuses to connect with PGSERVICE set, so the tools resolve them here.
+package pgservice
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// FileName is the name of the system-wide service file in libpq's sysconfdir.
+const FileName = "pg_service.conf"
+
+// Lookup returns the settings of the named service and the file that
+// defines it. Like libpq it reads the user's file, serviceFile (the value of
+// PGSERVICEFILE, which callers take out of the environment for lib/pq) or
+// ~/.pg_service.conf, before the system-wide one in PGSYSCONFDIR or the
+// sysconfdir pg_config reports; the first file defining the service wins.
+func Lookup(name, serviceFile string) (map[string]string, string, error) {
+	for _, path := range files(serviceFile) {
+		settings, found, err := read(path, name)
+		if err != nil {
+			return nil, "", err
+		}
+		if found {
+			return settings, path, nil
+		}
+	}
+	return nil, "", fmt.Errorf("definition of service %q not found in %s", name, strings.Join(files(serviceFile), " or "))
+}
+
+// files lists the service files Lookup reads, in order.
+func files(serviceFile string) []string {
+	var paths []string
+	if serviceFile != "" {
+		paths = append(paths, serviceFile)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(home, ".pg_service.conf"))
+	}
+
+	dir := os.Getenv("PGSYSCONFDIR")
+	if dir == "" {
+		if out, err := exec.Command("pg_config", "--sysconfdir").Output(); err == nil {
+			dir = strings.TrimSpace(string(out))
+		}
+	}
+	if dir != "" {
+		paths = append(paths, filepath.Join(dir, FileName))
+	}
+	return paths
+}
+
+// read returns the settings of service name in the file at path. A missing
+// file defines no services.
+func read(path, name string) (map[string]string, bool, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+
+	var settings map[string]string
+	section := ""
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "["):
+			if !strings.HasSuffix(line, "]") {
+				return nil, false, fmt.Errorf("syntax error in service file %s, line %d", path, n)
+			}
+			if settings != nil {
+				// The service ends at the next section
+				return settings, true, nil
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == name {
+				settings = map[string]string{}
+			}
+		default:
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, false, fmt.Errorf("syntax error in service file %s, line %d", path, n)
+			}
+			if settings != nil {
+				settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, false, err
+	}
+	return settings, settings != nil, nil
+}
@@ -0,0 +1,129 @@
+// Package report renders the summary of a save or restore run into the
+// self-contained HTML file both tools write with --report, for attaching to
+// change tickets. The template is embedded, the file needs nothing else.
+package report
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Failed is the outcome of a report on a run that failed. Runs that
+// succeeded use the sentinel outcomes.
+const Failed = "failed"
+
+// Phase is how long one step of a run took.
+type Phase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Timeline records the phases of a run as it goes. A nil *Timeline records
+// nothing, for callers that are not timed.
+type Timeline struct {
+	Start  time.Time
+	last   time.Time
+	phases []Phase
+}
+
+// NewTimeline starts timing a run.
+func NewTimeline() *Timeline {
+	now := time.Now()
+	return &Timeline{Start: now, last: now}
+}
+
+// Mark ends the phase called name: the time since the previous mark, or the
+// start, is recorded under it.
+func (t *Timeline) Mark(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	t.phases = append(t.phases, Phase{Name: name, Seconds: now.Sub(t.last).Round(time.Millisecond).Seconds()})
+	t.last = now
+}
+
+// Phases returns the phases recorded so far.
+func (t *Timeline) Phases() []Phase {
+	if t == nil {
+		return nil
+	}
+	return t.phases
+}
+
+// Field is one labelled value of a report.
+type Field struct {
+	Label string
+	Value string
+}
+
+// Report is what the HTML file shows.
+type Report struct {
+	Tool       string // "save" or "restore"
+	Outcome    string
+	Error      string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Summary    []Field
+	Source     []Field
+	Phases     []Phase
+}
+
+//go:embed report.html
+var pageTemplate string
+
+var page = template.Must(template.New("report").Funcs(template.FuncMap{
+	"seconds": func(s float64) string {
+		return (time.Duration(s * float64(time.Second))).Round(time.Millisecond).String()
+	},
+	"share": func(s float64, phases []Phase) float64 {
+		var total float64
+		for _, p := range phases {
+			total += p.Seconds
+		}
+		if total <= 0 {
+			return 0
+		}
+		return 100 * s / total
+	},
+}).Parse(pageTemplate))
+
+// Duration is how long the run took.
+func (r *Report) Duration() time.Duration {
+	return r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond)
+}
+
+// Write renders r to path, under a temporary name first so a half-written
+// report is never left behind.
+func Write(path string, r *Report) error {
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, r); err != nil {
+		return fmt.Errorf("failed to render report: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write report %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+// Package sentinel writes the completion marker both tools leave at
+// --sentinel for orchestration: a small JSON file that only exists after a
+// run succeeded.
+package sentinel
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Outcomes recorded in a marker.
+const (
+	Success = "success"
+	Skipped = "skipped" // save --skip-if-unchanged found nothing to back up
+)
+
+// Marker is the contents of the sentinel file.
+type Marker struct {
+	Tool       string    `json:"tool"`
+	Outcome    string    `json:"outcome"`
+	FinishedAt time.Time `json:"finished_at"`
+	Summary    any       `json:"summary,omitempty"`
+}
+
+// Clear removes a marker left by an earlier run, so the file's presence
+// always refers to the current one.
+func Clear(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale sentinel %s: %w", path, err)
+	}
+	return nil
+}
+
+// Write writes the marker to path. It is written under a temporary name in
+// the same directory and renamed into place, so a watcher never reads a
+// partial file.
+func Write(path, tool, outcome string, summary any) error {
+	data, err := json.MarshalIndent(Marker{
+		Tool:       tool,
+		Outcome:    outcome,
+		FinishedAt: time.Now().UTC(),
+		Summary:    summary,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write sentinel %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write sentinel %s: %w", path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write sentinel %s: %w", path, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write sentinel %s: %w", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write sentinel %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+// Package ui holds the terminal output helpers shared by the save and restore
+// tools, so both decide the same way whether to print ANSI colors.
+package ui
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ANSI escape sequences used for status messages.
+const (
+	Green  = "\033[0;32m"
+	Yellow = "\033[1;33m"
+	Red    = "\033[0;31m"
+	Blue   = "\033[0;34m"
+	Reset  = "\033[0m"
+	Bold   = "\033[1m"
+)
+
+// Color modes accepted by --color.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+var colorEnabled = detectColor()
+
+// output is where Println writes; commands whose stdout carries a report
+// point it at stderr with SetOutput.
+var output io.Writer = os.Stdout
+
+// SetOutput sends the status messages of Println, Warn and Output to w.
+func SetOutput(w io.Writer) {
+	output = w
+}
+
+// Output returns the writer status messages go to, for lines printed without
+// Println.
+func Output() io.Writer {
+	return output
+}
+
+// detectColor is the auto mode: colors on a terminal unless NO_COLOR is set
+// (https://no-color.org).
+func detectColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// SetColorMode switches colors on or off. always and never override both
+// terminal detection and NO_COLOR.
+func SetColorMode(mode string) error {
+	switch mode {
+	case ColorAuto:
+		colorEnabled = detectColor()
+	case ColorAlways:
+		colorEnabled = true
+	case ColorNever:
+		colorEnabled = false
+	default:
+		return fmt.Errorf("invalid color mode %q (expected always, never or auto)", mode)
+	}
+	return nil
+}
+
+// ColorEnabled reports whether output is colored.
+func ColorEnabled() bool {
+	return colorEnabled
+}
+
+// colorFlag applies the mode as soon as the flag is parsed.
+type colorFlag string
+
+func (f *colorFlag) String() string { return string(*f) }
+
+func (f *colorFlag) Set(value string) error {
+	if err := SetColorMode(value); err != nil {
+		return err
+	}
+	*f = colorFlag(value)
+	return nil
+}
+
+// AddColorFlag registers --color on fs.
+func AddColorFlag(fs *flag.FlagSet) {
+	mode := colorFlag(ColorAuto)
+	fs.Var(&mode, "color", "Colorize output: always, never or auto (default auto: only on a terminal and without NO_COLOR)")
+}
+
+// Colorize wraps s in color when colors are enabled.
+func Colorize(color, s string) string {
+	if color == "" || !colorEnabled {
+		return s
+	}
+	return color + s + Reset
+}
+
+// Println prints msg on its own line in color.
+func Println(color, msg string) {
+	fmt.Fprintln(output, Colorize(color, msg))
+}
+
+// strict is set by --strict; warnings counts the warnings it turned into
+// errors.
+var (
+	strict   bool
+	warnings int
+)
+
+// AddStrictFlag registers --strict on fs.
+func AddStrictFlag(fs *flag.FlagSet) {
+	fs.BoolVar(&strict, "strict", false, "Treat warnings as errors and exit nonzero, for unattended runs")
+}
+
+// Warn prints msg as a warning. With --strict it is printed as an error
+// instead and StrictError fails from then on. Leading spaces of msg are kept
+// as indentation.
+func Warn(msg string) {
+	text := strings.TrimLeft(msg, " ")
+	indent := msg[:len(msg)-len(text)]
+	if strict {
+		warnings++
+		Println(Red, indent+"Error (--strict): "+text)
+		return
+	}
+	Println(Yellow, indent+"Warning: "+text)
+}
+
+// StrictError returns an error once Warn was called with --strict. The tools
+// check it before they change anything that cannot be undone and before
+// exiting.
+func StrictError() error {
+	if warnings == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d warning(s) treated as errors (--strict)", warnings)
+}
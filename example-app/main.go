@@ -2,6 +2,7 @@ package main
 
 import (
 	"database/sql"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -16,10 +17,17 @@ type DBConfig struct {
 	User     string
 	Password string
 	Database string
+	SSLMode  string
 }
 
 func main() {
-	config := getDBConfig()
+	service := flag.String("service", os.Getenv("PGSERVICE"), "Connection service in pg_service.conf to take the database settings from")
+	flag.Parse()
+
+	config, err := getDBConfig(*service)
+	if err != nil {
+		log.Fatal("Failed to read service:", err)
+	}
 
 	fmt.Println("Connecting to TimescaleDB...")
 	db, err := connectToDB(config)
@@ -44,19 +52,44 @@ func main() {
 	fmt.Println("\nConnection closed.")
 }
 
-func getDBConfig() DBConfig {
-	return DBConfig{
+func getDBConfig(service string) (DBConfig, error) {
+	config := DBConfig{
 		Host:     getEnv("PGHOST", "sych.local"),
 		Port:     getEnv("PGPORT", "8094"),
 		User:     getEnv("PGUSER", "jettison"),
 		Password: getEnv("PGPASSWORD", "aMvzpGPgNVtH53S"),
 		Database: getEnv("PGDATABASE", "jettison"),
+		SSLMode:  "disable",
+	}
+
+	// lib/pq refuses to connect with PGSERVICE set, so the service is read here
+	defer os.Unsetenv("PGSERVICE")
+	defer os.Unsetenv("PGSERVICEFILE")
+	if service == "" {
+		return config, nil
+	}
+	settings, err := lookupService(service)
+	if err != nil {
+		return config, err
+	}
+	for key, field := range map[string]*string{
+		"host":     &config.Host,
+		"port":     &config.Port,
+		"user":     &config.User,
+		"password": &config.Password,
+		"dbname":   &config.Database,
+		"sslmode":  &config.SSLMode,
+	} {
+		if value, ok := settings[key]; ok {
+			*field = value
+		}
 	}
+	return config, nil
 }
 
 func connectToDB(config DBConfig) (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		config.Host, config.Port, config.User, config.Password, config.Database)
+	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		config.Host, config.Port, config.User, config.Password, config.Database, config.SSLMode)
 
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// lookupService returns the settings of the named service from
+// PGSERVICEFILE or ~/.pg_service.conf, then pg_service.conf in
+// PGSYSCONFDIR or pg_config's sysconfdir, as libpq reads them.
+func lookupService(name string) (map[string]string, error) {
+	var files []string
+	if path := os.Getenv("PGSERVICEFILE"); path != "" {
+		files = append(files, path)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".pg_service.conf"))
+	}
+	dir := os.Getenv("PGSYSCONFDIR")
+	if dir == "" {
+		if out, err := exec.Command("pg_config", "--sysconfdir").Output(); err == nil {
+			dir = strings.TrimSpace(string(out))
+		}
+	}
+	if dir != "" {
+		files = append(files, filepath.Join(dir, "pg_service.conf"))
+	}
+
+	for _, path := range files {
+		settings, err := readService(path, name)
+		if err != nil {
+			return nil, err
+		}
+		if settings != nil {
+			return settings, nil
+		}
+	}
+	return nil, fmt.Errorf("definition of service %q not found", name)
+}
+
+// readService returns the settings of service name in the file at path, or
+// nil if the file does not define it.
+func readService(path, name string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var settings map[string]string
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			if settings != nil {
+				break
+			}
+			if strings.TrimSpace(line[1:len(line)-1]) == name {
+				settings = map[string]string{}
+			}
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("syntax error in service file %s, line %d", path, n)
+		}
+		if settings != nil {
+			settings[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return settings, scanner.Err()
+}